@@ -0,0 +1,249 @@
+//
+//  authkey -- logging auth keys, and what each may be used for
+//
+//  An auth key can be handed to a vehicle maker, who can then log only
+//  for the owners, objects, and grids the key allows. In the config file,
+//  a key is either just the secret, as before,
+//
+//    "Authkey": {"MAR2018": "secret"}
+//
+//  which allows anything, or the secret with a policy:
+//
+//    "Authkey": {"MAKER1": {"Secret": "secret", "Owners": ["dadec334-539a-4875-ad0e-d9654705f437"],
+//        "Objects": ["Maker1 *"], "Grids": ["osgrid.org"], "Expires": "2027-01-01"}}
+//
+//  Empty lists allow anything. A key is enabled unless "Enabled" is false.
+//
+//  To rotate a secret without redeploying every vehicle script at once,
+//  a key can have several versions, oldest first, each valid for a window:
+//
+//    "MAKER1": {"Versions": [
+//        {"Version": "2026a", "Secret": "old", "Notafter": "2026-12-01"},
+//        {"Version": "2026b", "Secret": "new", "Notbefore": "2026-10-01"}]}
+//
+//  Once a newer version is in effect, the older one is retired. It still
+//  works until its window closes, but each use is logged in the errorlog,
+//  with the owner and object, so stragglers can be found and updated.
+//
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+//
+//  authversion -- one secret of an auth key
+//
+type authversion struct {
+	Version   string    // label, reported when used; "" for a key with one secret
+	Secret    string    // signing secret
+	Notbefore time.Time // not accepted before this; zero for no limit
+	Notafter  time.Time // not accepted at or after this; zero for no limit
+}
+
+//
+//  ineffect -- true if this secret is accepted now
+//
+func (v authversion) ineffect(now time.Time) bool {
+	return (v.Notbefore.IsZero() || !now.Before(v.Notbefore)) && (v.Notafter.IsZero() || now.Before(v.Notafter))
+}
+
+//
+//  authkey -- one auth key
+//
+type authkey struct {
+	Versions []authversion // secrets, oldest first
+	Enabled  bool          // false to turn the key off without removing it
+	Owners   []string      // owner keys allowed, lower case; any if empty
+	Objects  []string      // object name patterns allowed, as for path.Match; any if empty
+	Grids    []string      // grids allowed, as from Parsegrid; any if empty
+	Expires  time.Time     // not accepted at or after this; never expires if zero
+}
+
+//
+//  UnmarshalJSON -- auth key from config, as a plain secret string or with a policy
+//
+func (k *authkey) UnmarshalJSON(data []byte) error {
+	var secret string
+	if err := json.Unmarshal(data, &secret); err == nil { // plain secret, allows anything
+		*k = authkey{Enabled: true}
+		if secret != "" { // empty means no key, as always
+			k.Versions = []authversion{{Secret: secret}}
+		}
+		return nil
+	}
+	var raw struct {
+		Secret   string // the only secret, or the oldest
+		Versions []struct {
+			Version   string
+			Secret    string
+			Notbefore string
+			Notafter  string
+		}
+		Enabled *bool // missing means enabled
+		Owners  []string
+		Objects []string
+		Grids   []string
+		Expires string // "2027-01-01", UTC, or RFC 3339
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*k = authkey{Enabled: raw.Enabled == nil || *raw.Enabled, Objects: raw.Objects, Grids: raw.Grids}
+	if raw.Secret != "" {
+		k.Versions = append(k.Versions, authversion{Secret: raw.Secret})
+	}
+	for _, rv := range raw.Versions {
+		if rv.Secret == "" {
+			return fmt.Errorf("Auth key version \"%s\" has no secret", rv.Version)
+		}
+		v := authversion{Version: rv.Version, Secret: rv.Secret}
+		var err error
+		if v.Notbefore, err = parseconfigtime(rv.Notbefore); err != nil {
+			return err
+		}
+		if v.Notafter, err = parseconfigtime(rv.Notafter); err != nil {
+			return err
+		}
+		k.Versions = append(k.Versions, v)
+	}
+	if len(k.Versions) == 0 {
+		return fmt.Errorf("Auth key has no secret")
+	}
+	for _, owner := range raw.Owners {
+		if !isuuid(owner) {
+			return fmt.Errorf("Auth key owner \"%s\" is not a key", owner)
+		}
+		k.Owners = append(k.Owners, strings.ToLower(owner))
+	}
+	for _, pattern := range raw.Objects {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Auth key object pattern \"%s\": %s", pattern, err)
+		}
+	}
+	var err error
+	k.Expires, err = parseconfigtime(raw.Expires)
+	return err
+}
+
+//
+//  parseconfigtime -- "2027-01-01", UTC, or RFC 3339. Zero time if empty.
+//
+func parseconfigtime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		t, err = time.Parse(time.RFC3339, s)
+	}
+	if err != nil {
+		return t, fmt.Errorf("Auth key time \"%s\" is not a date", s)
+	}
+	return t, nil
+}
+
+//
+//  authmatch -- which secret of a key signed a request
+//
+type authmatch struct {
+	name    string    // key name
+	version string    // version label
+	retired bool      // a newer version is in effect
+	nonce   usednonce // nonce of the signed message, to store with its events
+}
+
+//
+//  matchversion -- the version of key k whose secret signed s with hash value
+//
+//  A version is retired once any version after it is in effect.
+//
+func (k authkey) matchversion(name string, s []byte, value string, now time.Time) (authmatch, error) {
+	for i, v := range k.Versions {
+		if Hashwithtoken([]byte(v.Secret), s) != value {
+			continue
+		}
+		m := authmatch{name: name, version: v.Version}
+		if !v.ineffect(now) {
+			return m, &autherror{true, fmt.Errorf("Logging authorization token \"%s\" version \"%s\" is not valid now.", name, v.Version)}
+		}
+		for _, later := range k.Versions[i+1:] {
+			m.retired = m.retired || later.ineffect(now)
+		}
+		return m, nil
+	}
+	return authmatch{name: name}, &autherror{true, fmt.Errorf("Logging authorization token \"%s\" failed to validate. Hash sent: \"%s\"",
+		name, value)}
+}
+
+//
+//  warnretired -- log use of a retired key version, and by whom
+//
+func warnretired(store vehstore, m authmatch, hdr slheader) {
+	if !m.retired {
+		return
+	}
+	msg := fmt.Sprintf("Retired version \"%s\" of logging authorization token \"%s\" used by object \"%s\" (%s) of owner \"%s\" (%s) in %s",
+		m.version, m.name, hdr.Object_name, hdr.Object_key, hdr.Owner_name, hdr.Owner_key, hdr.Region.Name)
+	recorderror(store, ownersource(hdr.Owner_key), errorlogentry{owner_name: hdr.Owner_name, category: categoryretiredkey, msg: msg})
+}
+
+//
+//  allows -- true if s is in list, or list is empty
+//
+func allows(list []string, s string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+//
+//  allowsobject -- true if object name matches a pattern, or there are none
+//
+func (k authkey) allowsobject(name string) bool {
+	if len(k.Objects) == 0 {
+		return true
+	}
+	for _, pattern := range k.Objects {
+		if ok, _ := path.Match(pattern, name); ok { // patterns checked when config read
+			return true
+		}
+	}
+	return false
+}
+
+//
+//  Authorizekey -- check that a validated key may log for this owner, object, and grid
+//
+//  Called after Validateauthtoken and Parseheader, so the key exists and the
+//  header is good.
+//
+func Authorizekey(name string, hdr slheader, config vdbconfig, now time.Time) error {
+	k := config.Authkey[name]
+	var reason string
+	switch {
+	case !k.Enabled:
+		reason = "is disabled"
+	case !k.Expires.IsZero() && !now.Before(k.Expires):
+		reason = "expired " + k.Expires.Format(time.RFC3339)
+	case !allows(k.Owners, hdr.Owner_key):
+		reason = fmt.Sprintf("does not allow owner \"%s\" (%s)", hdr.Owner_name, hdr.Owner_key)
+	case !k.allowsobject(hdr.Object_name):
+		reason = fmt.Sprintf("does not allow object \"%s\"", hdr.Object_name)
+	case !allows(k.Grids, hdr.Grid):
+		reason = fmt.Sprintf("does not allow grid \"%s\"", hdr.Grid)
+	default:
+		return nil
+	}
+	return &autherror{true, fmt.Errorf("Logging authorization token \"%s\" %s.", name, reason)}
+}
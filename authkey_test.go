@@ -0,0 +1,180 @@
+//
+//  Tests for auth key policy
+//
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testauthconfig = `{"Authkey": {
+	"MAR2018": "plainsecret",
+	"MAKER1": {"Secret": "maker1secret", "Owners": ["DADEC334-539A-4875-AD0E-D9654705F437"],
+		"Objects": ["Logging tester *"], "Grids": ["Production"], "Expires": "2030-01-01"},
+	"OFF": {"Secret": "offsecret", "Enabled": false}}}`
+
+func TestAuthkeyConfig(t *testing.T) {
+	var config vdbconfig
+	if err := json.Unmarshal([]byte(testauthconfig), &config); err != nil {
+		t.Fatal(err)
+	}
+	if k := config.Authkey["MAR2018"]; len(k.Versions) != 1 || k.Versions[0].Secret != "plainsecret" || !k.Enabled || k.Owners != nil || !k.Expires.IsZero() {
+		t.Errorf("Plain key: %+v", k)
+	}
+	k := config.Authkey["MAKER1"]
+	if len(k.Versions) != 1 || k.Versions[0].Secret != "maker1secret" || !k.Enabled || len(k.Owners) != 1 || k.Owners[0] != "dadec334-539a-4875-ad0e-d9654705f437" ||
+		!k.Expires.Equal(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Policy key: %+v", k)
+	}
+	if config.Authkey["OFF"].Enabled {
+		t.Errorf("Disabled key enabled")
+	}
+	for _, bad := range []string{
+		`{"Authkey": {"X": {"Owners": ["dadec334-539a-4875-ad0e-d9654705f437"]}}}`, // no secret
+		`{"Authkey": {"X": {"Secret": "s", "Owners": ["animats Resident"]}}}`,
+		`{"Authkey": {"X": {"Secret": "s", "Objects": ["["]}}}`,
+		`{"Authkey": {"X": {"Secret": "s", "Expires": "next year"}}}`,
+		`{"Authkey": {"X": 12}}`,
+	} {
+		var config vdbconfig
+		if err := json.Unmarshal([]byte(bad), &config); err == nil {
+			t.Errorf("Bad config accepted: %s", bad)
+		}
+	}
+}
+
+func TestAuthorizekey(t *testing.T) {
+	var config vdbconfig
+	if err := json.Unmarshal([]byte(testauthconfig), &config); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	hdr, _ := testevent("x", 0)
+	tests := []struct {
+		name   string
+		change func(h *slheader)
+		now    time.Time
+		ok     bool
+	}{
+		{"MAKER1", func(h *slheader) {}, now, true},
+		{"MAR2018", func(h *slheader) { h.Owner_key = "0e9ebf4b-0d3a-4b5a-9f4e-1b7e1f4a6c11" }, now, true}, // plain key allows anything
+		{"MAKER1", func(h *slheader) { h.Owner_key = "0e9ebf4b-0d3a-4b5a-9f4e-1b7e1f4a6c11" }, now, false},
+		{"MAKER1", func(h *slheader) { h.Object_name = "Motorcycle" }, now, false},
+		{"MAKER1", func(h *slheader) { h.Grid = "osgrid.org" }, now, false},
+		{"MAKER1", func(h *slheader) {}, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), false},
+		{"OFF", func(h *slheader) {}, now, false},
+	}
+	for i, test := range tests {
+		h := hdr
+		test.change(&h)
+		err := Authorizekey(test.name, h, config, test.now)
+		if test.ok != (err == nil) {
+			t.Errorf("Test %d, key %s: got %v", i, test.name, err)
+		} else if e, isauth := err.(*autherror); err != nil && (!isauth || !e.forbidden) {
+			t.Errorf("Test %d, key %s: got %T %v, expected forbidden auth error", i, test.name, err, err)
+		}
+	}
+}
+
+func TestAuthkeyPolicyRequest(t *testing.T) {
+	config := testconfig()
+	config.Authkey["MAKER1"] = authkey{Versions: []authversion{{Secret: "maker1secret"}}, Enabled: true, Objects: []string{"Motorcycle*"}}
+	sv := new(FastCGIServer)
+	if err := initserver(config, sv); err != nil {
+		t.Fatal(err)
+	}
+	testjson := []byte(strings.Replace(testjson1, "TRIPID", GenerateRandomTripid(), 1))
+	hdr := http.Header{}
+	for k, v := range testheader1 {
+		hdr[k] = v
+	}
+	hdr.Set("X-Authtoken-Name", "MAKER1")
+	hdr.Set("X-Authtoken-Hash", Hashwithtoken([]byte("maker1secret"), testjson))
+	code, reply := postevent(t, sv, testjson, hdr)
+	if code != http.StatusForbidden || reply.Status != statusbadauth {
+		t.Errorf("Object not allowed by key: got %d %s, expected 403 %s", code, reply.Status, statusbadauth)
+	}
+	hdr.Set("X-Secondlife-Object-Name", "Motorcycle 2.1")
+	if code, reply = postevent(t, sv, testjson, hdr); code != http.StatusOK || reply.Status != statusok {
+		t.Errorf("Object allowed by key: got %d %+v", code, reply)
+	}
+}
+
+var testrotationconfig = `{"Authkey": {"MAKER1": {"Versions": [
+	{"Version": "2026a", "Secret": "oldsecret", "Notafter": "2026-12-01"},
+	{"Version": "2026b", "Secret": "newsecret", "Notbefore": "2026-10-01T00:00:00Z"}]}}}`
+
+func TestKeyVersions(t *testing.T) {
+	var config vdbconfig
+	if err := json.Unmarshal([]byte(testrotationconfig), &config); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { servernow = time.Now }()
+	tests := []struct {
+		secret  string
+		now     time.Time
+		version string // "" if rejected
+		retired bool
+	}{
+		{"oldsecret", time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC), "2026a", false},  // before rotation
+		{"newsecret", time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC), "", false},       // too early
+		{"oldsecret", time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC), "2026a", true},  // during transition
+		{"newsecret", time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC), "2026b", false}, // during transition
+		{"oldsecret", time.Date(2026, 12, 1, 0, 0, 0, 0, time.UTC), "", false},      // too late
+		{"newsecret", time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC), "2026b", false},
+		{"badsecret", time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC), "", false},
+	}
+	for i, test := range tests {
+		servernow = func() time.Time { return test.now }
+		m, err := Validateauthtoken(testjson2, "MAKER1", Hashwithtoken([]byte(test.secret), testjson2), config)
+		if test.version == "" {
+			if e, ok := err.(*autherror); !ok || !e.forbidden {
+				t.Errorf("Test %d: got %v, expected forbidden auth error", i, err)
+			}
+			continue
+		}
+		if err != nil || m.version != test.version || m.retired != test.retired {
+			t.Errorf("Test %d: version \"%s\", retired %v, err %v; expected \"%s\", %v", i, m.version, m.retired, err, test.version, test.retired)
+		}
+	}
+}
+
+func TestRetiredKeyWarning(t *testing.T) {
+	config := testconfig()
+	if err := json.Unmarshal([]byte(testrotationconfig), &config); err != nil {
+		t.Fatal(err)
+	}
+	sv := new(FastCGIServer)
+	if err := initserver(config, sv); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { servernow = time.Now }()
+	servernow = func() time.Time { return time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC) }
+	post := func(secret string, version string) {
+		testjson := []byte(strings.Replace(testjson1, "TRIPID", GenerateRandomTripid(), 1))
+		hdr := http.Header{}
+		for k, v := range testheader1 {
+			hdr[k] = v
+		}
+		hdr.Set("X-Secondlife-Owner-Name", "Rotation Tester") // own errorlog entries
+		hdr.Set("X-Authtoken-Name", "MAKER1")
+		hdr.Set("X-Authtoken-Hash", Hashwithtoken([]byte(secret), testjson))
+		if code, reply := postevent(t, sv, testjson, hdr); code != http.StatusOK || reply.Keyversion != version {
+			t.Errorf("Secret %s: got %d %+v, expected key version \"%s\"", secret, code, reply, version)
+		}
+	}
+	post("newsecret", "2026b")
+	if entries, _ := sv.store.recenterrors("Rotation Tester", "", 10); len(entries) != 0 {
+		t.Errorf("Current key version logged: %+v", entries)
+	}
+	post("oldsecret", "2026a")
+	entries, err := sv.store.recenterrors("Rotation Tester", "", 10)
+	if err != nil || len(entries) != 1 || entries[0].category != categoryretiredkey ||
+		!strings.Contains(entries[0].msg, "\"2026a\"") || !strings.Contains(entries[0].msg, "b23730f8-4105-594a-c359-e72f9fece699") {
+		t.Errorf("Retired key version use not logged: %+v, err %v", entries, err)
+	}
+}
@@ -0,0 +1,191 @@
+//
+//  batch -- batch submission of events
+//
+//  A batch is a JSON array of events, signed as a whole and sent with one
+//  set of X-Secondlife-* headers. Each event may carry its own region and
+//  position, for events queued up while the vehicle was moving, and its
+//  own velocity and rotation.
+//
+//  [{"tripid":"...","serial":5,"type":"CROSSSPEED",...,"region":"Vallone (462592, 306944)","pos":"(3.2, 100.5, 22.0)",
+//    "vel":"(8.5, 0.2, 0.0)","rot":"(0.0, 0.0, 0.0, 1.0)"}, ...]
+//
+//  The velocity and rotation headers are the vehicle's state when the batch
+//  was sent, not when the events happened, so they aren't used for batch
+//  events. An event without both "vel" and "rot" has no motion data, and
+//  is left out of speed, turning, flip and spin statistics.
+//
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+//
+//  Per-event status values
+//
+const (
+	batchaccepted  = "accepted"  // stored
+	batchduplicate = "duplicate" // already stored; don't resend
+	batchconflict  = "conflict"  // different event with this serial already stored
+	batchrejected  = "rejected"  // bad event; resending won't help
+)
+
+//
+//  batchevent -- an event in a batch, with optional position overrides
+//
+type batchevent struct {
+	vehlogevent
+	Region string // "Name (x, y)", overrides X-Secondlife-Region if present
+	Pos    string // "(x, y, z)", overrides X-Secondlife-Local-Position if present
+	Vel    string // "(x, y, z)", velocity when the event happened
+	Rot    string // "(x, y, z, s)", rotation when the event happened
+}
+
+//
+//  batchresult -- what happened to one event of a batch
+//
+type batchresult struct {
+	Serial int32  `json:"serial"`
+	Tripid string `json:"tripid"`
+	Status string `json:"status"`        // accepted, duplicate, rejected
+	Msg    string `json:"msg,omitempty"` // why rejected
+}
+
+//
+//  isbatch -- is this body a batch of events, rather than one event?
+//
+func isbatch(bodycontent []byte) bool {
+	body := bytes.TrimSpace(bodycontent)
+	return len(body) > 0 && body[0] == '['
+}
+
+//
+//  Parsebatchevent -- parse one event of a batch, applying position and motion overrides
+//
+func Parsebatchevent(s []byte, hdr slheader) (slheader, vehlogevent, error) {
+	ev, err := Parsevehevent(s) // the event fields
+	if err != nil {
+		return hdr, ev, err
+	}
+	var be batchevent
+	err = json.Unmarshal(s, &be) // the override fields
+	if err != nil {
+		return hdr, ev, &eventerror{err}
+	}
+	if strings.TrimSpace(be.Region) != "" {
+		hdr.Region, err = Parseslregion(be.Region)
+		if err != nil {
+			return hdr, ev, &eventerror{fmt.Errorf("Bad region override: %s", err)}
+		}
+	}
+	if strings.TrimSpace(be.Pos) != "" {
+		hdr.Local_position, err = Parseslvector(be.Pos)
+		if err != nil {
+			return hdr, ev, &eventerror{fmt.Errorf("Bad position override: %s", err)}
+		}
+	}
+	hdr.Local_velocity, hdr.Local_rotation = slvector{}, slquaternion{} // unknown, unless sent with event
+	if strings.TrimSpace(be.Vel) != "" && strings.TrimSpace(be.Rot) != "" {
+		hdr.Local_velocity, err = Parseslvector(be.Vel)
+		if err != nil {
+			return hdr, ev, &eventerror{fmt.Errorf("Bad velocity: %s", err)}
+		}
+		hdr.Local_rotation, err = Parseslrotation(be.Rot)
+		if err != nil {
+			return hdr, ev, &eventerror{fmt.Errorf("Bad rotation: %s", err)}
+		}
+	}
+	return hdr, ev, nil
+}
+
+//
+//  Addevents -- add a batch of events to the database
+//
+//  The batch is authenticated and its header parsed once. Events which
+//  don't parse are rejected individually; the rest go in one transaction.
+//  If none parse, the batch as a whole is rejected too, with the results.
+//  Also returns which key version signed the batch.
+//
+func Addevents(bodycontent []byte, headervars http.Header, config vdbconfig, store vehstore) ([]batchresult, authmatch, error) {
+	//  Validate auth token first
+	match, err := Authenticate(bodycontent, headervars, config)
+	if err != nil {
+		return nil, match, err
+	}
+	hdr, err := Parseheader(headervars) // parse HTTP header
+	if err != nil {
+		return nil, match, err
+	}
+	hdr.Grid, err = Parsegrid(headervars, hdr.Shard, config)
+	if err != nil {
+		return nil, match, err
+	}
+	err = Authorizekey(match.name, hdr, config, servernow()) // batch events all have this owner and object
+	if err != nil {
+		return nil, match, err
+	}
+	warnretired(store, match, hdr)
+	var items []json.RawMessage
+	err = json.Unmarshal(bodycontent, &items) // split into events
+	if err != nil {
+		return nil, match, &eventerror{err}
+	}
+	if len(items) == 0 {
+		return nil, match, &eventerror{errors.New("Empty batch of events")}
+	}
+	results := make([]batchresult, len(items))
+	var events []tripevent // events to store
+	var index []int        // result index for each event to store
+	for i, item := range items {
+		evhdr, ev, err := Parsebatchevent(item, hdr)
+		results[i] = batchresult{Serial: ev.Serial, Tripid: ev.Tripid, Status: batchaccepted}
+		if err != nil {
+			results[i].Status = batchrejected
+			results[i].Msg = err.Error()
+			recorderror(store, ownersource(hdr.Owner_key), errorlogentry{owner_name: hdr.Owner_name, tripid: ev.Tripid, category: statusbadjson,
+				msg: fmt.Sprintf("Batch event %d rejected: %s", i, err)})
+			continue
+		}
+		stampevent(&ev) // server time and clock check
+		events = append(events, tripevent{hdr: evhdr, ev: ev})
+		index = append(index, i)
+	}
+	if len(events) == 0 { // nothing usable
+		return results, match, &eventerror{fmt.Errorf("None of the %d events in batch are valid", len(items))}
+	}
+	errs, err := store.appendevents(events, match.nonce) // insert in database
+	nonces.prune(store, servernow())
+	if err == errReplayedNonce {
+		if !isresend(store, events) {
+			return nil, match, &autherror{true, err}
+		}
+		errs, err = make([]error, len(events)), nil // same batch sent again; each duplicate or conflict, as before
+		for j := range errs {
+			errs[j] = errDuplicateEvent
+		}
+	}
+	if err != nil {
+		return nil, match, err
+	}
+	for j, err := range errs {
+		i := index[j]
+		if err == errDuplicateEvent {
+			err = resolveduplicate(store, events[j].hdr, events[j].ev)
+		}
+		if err == errDuplicateEvent {
+			results[i].Status = batchduplicate
+		} else if err == errConflictEvent {
+			results[i].Status = batchconflict
+			results[i].Msg = err.Error()
+		} else if err != nil {
+			results[i].Status = batchrejected
+			results[i].Msg = err.Error()
+		}
+	}
+	return results, match, nil
+}
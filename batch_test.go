@@ -0,0 +1,116 @@
+//
+//  Tests for batch event submission
+//
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+//
+//  testbatch -- two good events, one with position and motion overrides, and one bad one
+//
+func testbatch(tripid string) []byte {
+	return []byte(fmt.Sprintf(`[
+{"timestamp":1521350914,"serial":0,"tripid":"%s","severity":1,"type":"STARTUP","msg":"animats Resident/Joe Magarac","auxval":0},
+{"timestamp":1521350915,"serial":1,"tripid":"%s","severity":1,"type":"CROSSSPEED","msg":"","auxval":8.5,"region":"Neumoegen (257280, 260096)","pos":"(255.1, 53.5, 22.0)",
+ "vel":"(8.5, 0.0, 0.0)","rot":"(0.0, 0.0, 0.707107, 0.707107)"},
+{"timestamp":1521350916,"serial":2,"tripid":"TOOSHORT","severity":1,"type":"CROSSEND","msg":"","auxval":0.04}
+]`, tripid, tripid))
+}
+
+//
+//  postbatch -- sign and send a batch, return the decoded per-event results
+//
+func postbatch(t *testing.T, sv *FastCGIServer, body []byte) []batchresult {
+	hdr := http.Header{}
+	for k, v := range testheader1 {
+		hdr[k] = v
+	}
+	SignLogMsg(body, hdr, testtokenname)
+	req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	req.Header = hdr
+	w := httptest.NewRecorder()
+	sv.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Batch request: status %d, body %s", w.Code, w.Body.String())
+	}
+	var reply ingestresponse
+	err := json.Unmarshal(w.Body.Bytes(), &reply)
+	if err != nil {
+		t.Fatalf("Batch response \"%s\" not valid JSON: %s", w.Body.String(), err)
+	}
+	if reply.Status != statusok {
+		t.Errorf("Batch status %s, expected %s", reply.Status, statusok)
+	}
+	return reply.Results
+}
+
+func checkbatch(t *testing.T, sv *FastCGIServer) {
+	tripid := GenerateRandomTripid()
+	body := testbatch(tripid)
+	results := postbatch(t, sv, body)
+	expected := []string{batchaccepted, batchaccepted, batchrejected}
+	if len(results) != len(expected) {
+		t.Fatalf("Got %d results, expected %d", len(results), len(expected))
+	}
+	for i := range expected {
+		if results[i].Status != expected[i] {
+			t.Errorf("Event %d: status %s, expected %s (%s)", i, results[i].Status, expected[i], results[i].Msg)
+		}
+	}
+	events, err := sv.store.tripevents(tripid)
+	if err != nil || len(events) != 2 {
+		t.Fatalf("Stored %d events, expected 2, err %v", len(events), err)
+	}
+	if events[0].hdr.Region.Name != "Vallone" || events[1].hdr.Region.Name != "Neumoegen" {
+		t.Errorf("Position override not applied: regions %s, %s", events[0].hdr.Region.Name, events[1].hdr.Region.Name)
+	}
+	if events[1].hdr.Local_position.X != 255.1 {
+		t.Errorf("Position override not applied: position %s", events[1].hdr.Local_position)
+	}
+	if events[0].hdr.Local_rotation.known() || events[1].hdr.Local_velocity.X != 8.5 || events[1].hdr.Local_rotation.Z != 0.707107 {
+		t.Errorf("Motion: event 0 rotation %s, should be unknown; event 1 velocity %s, rotation %s",
+			events[0].hdr.Local_rotation, events[1].hdr.Local_velocity, events[1].hdr.Local_rotation)
+	}
+	//  Resend; the good events are now duplicates
+	results = postbatch(t, sv, body)
+	expected = []string{batchduplicate, batchduplicate, batchrejected}
+	for i := range expected {
+		if results[i].Status != expected[i] {
+			t.Errorf("Resent event %d: status %s, expected %s", i, results[i].Status, expected[i])
+		}
+	}
+	//  Resend with a changed message, and changed motion; those are conflicts
+	body = bytes.Replace(body, []byte("Joe Magarac"), []byte("Joe Palooka"), 1)
+	body = bytes.Replace(body, []byte("(8.5, 0.0, 0.0)"), []byte("(8.5, 1.0, 0.0)"), 1)
+	results = postbatch(t, sv, body)
+	expected = []string{batchconflict, batchconflict, batchrejected}
+	for i := range expected {
+		if results[i].Status != expected[i] {
+			t.Errorf("Changed event %d: status %s, expected %s", i, results[i].Status, expected[i])
+		}
+	}
+}
+
+func TestBatchNoneValid(t *testing.T) {
+	sv := newtestserver(t)
+	body := []byte(`[{"timestamp":1521350914,"serial":0,"tripid":"TOOSHORT","severity":1,"type":"STARTUP","msg":"","auxval":0},
+{"serial":1}]`)
+	code, reply := postevent(t, sv, body, signedheader(body))
+	if code != http.StatusBadRequest || reply.Status != statusbadjson {
+		t.Errorf("Batch of bad events: got %d %s, expected 400 %s", code, reply.Status, statusbadjson)
+	}
+	if len(reply.Results) != 2 || reply.Results[0].Status != batchrejected || reply.Results[1].Status != batchrejected {
+		t.Errorf("Batch of bad events: results %+v, expected 2 rejected", reply.Results)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	forservers(t, checkbatch)
+}
@@ -0,0 +1,97 @@
+//
+//  clockskew -- check client timestamps against the server clock
+//
+//  Every event is stamped with the server's receive time. An event whose
+//  client timestamp is too far from that is flagged as suspect. At summary
+//  time, the trip's skew is the median of (received - timestamp), and if the
+//  script's clock is clearly wrong, elapsed time comes from corrected times.
+//
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+//
+//  Constants
+//
+const defaultmaxfuturesecs = 300 // client clock this far ahead is suspect
+const defaultmaxpastsecs = 3600  // client clock this far behind is suspect
+
+//
+//  servernow -- server clock. Replaceable for testing.
+//
+var servernow = time.Now
+
+//
+//  skewlimits -- how far client time may be from server time
+//
+type skewlimits struct {
+	maxfuture int64 // seconds client may be ahead
+	maxpast   int64 // seconds client may be behind, including delivery delay
+}
+
+func newskewlimits(maxfuture int64, maxpast int64) skewlimits {
+	if maxfuture <= 0 {
+		maxfuture = defaultmaxfuturesecs
+	}
+	if maxpast <= 0 {
+		maxpast = defaultmaxpastsecs
+	}
+	return skewlimits{maxfuture: maxfuture, maxpast: maxpast}
+}
+
+//
+//  skewlimit -- limits for this process. Set from config by initserver.
+//
+var skewlimit = newskewlimits(0, 0)
+
+//
+//  outside -- true if skew, server time minus client time, is outside limits
+//
+func (l skewlimits) outside(skew int64) bool {
+	return skew < -l.maxfuture || skew > l.maxpast
+}
+
+//
+//  stampevent -- record server receive time, and flag event if client time is off
+//
+func stampevent(ev *vehlogevent) {
+	ev.Received = servernow().Unix()
+	ev.Suspect = skewlimit.outside(ev.Received - ev.Timestamp)
+}
+
+//
+//  clockskew -- median of received - timestamp for a trip
+//
+//  False if no event has a receive time, as with events logged before
+//  receive times were recorded.
+//
+func clockskew(events []tripevent) (int64, bool) {
+	var skews []int64
+	for _, te := range events {
+		if te.ev.Received != 0 {
+			skews = append(skews, te.ev.Received-te.ev.Timestamp)
+		}
+	}
+	if len(skews) == 0 {
+		return 0, false
+	}
+	sort.Slice(skews, func(i, j int) bool { return skews[i] < skews[j] })
+	return skews[len(skews)/2], true
+}
+
+//
+//  correctedtime -- event time on the server clock, given the trip's skew
+//
+//  Normally the client time shifted by the trip skew. An event which is
+//  off by itself, as when the script's clock jumped, gets its receive time.
+//
+func correctedtime(ev vehlogevent, skew int64) int64 {
+	t := ev.Timestamp + skew
+	if ev.Received != 0 && skewlimit.outside(ev.Received-t) {
+		return ev.Received
+	}
+	return t
+}
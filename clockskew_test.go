@@ -0,0 +1,86 @@
+//
+//  Tests for clock skew checks
+//
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSuspectTimestamp(t *testing.T) {
+	sv := newtestserver(t)
+	defer func() { servernow = time.Now }()
+	servernow = func() time.Time { return time.Unix(1521264571, 0) }
+	tripid := GenerateRandomTripid()
+	for i, ts := range []string{"1521264570", "1521364571"} { // about right, a day ahead
+		testjson := []byte(strings.NewReplacer("TRIPID", tripid, "1234", ts, `"severity"`, fmt.Sprintf(`"serial":%d,"severity"`, i)).Replace(testjson1))
+		_, reply := postevent(t, sv, testjson, signedheader(testjson))
+		if reply.Status != statusok || reply.Received != 1521264571 {
+			t.Fatalf("Event %d: got %+v", i, reply)
+		}
+	}
+	events, _ := sv.store.tripevents(tripid)
+	if len(events) != 2 || events[0].ev.Suspect || !events[1].ev.Suspect {
+		t.Errorf("Expected second event only to be suspect: %+v", events)
+	}
+	if events[0].ev.Received != 1521264571 {
+		t.Errorf("Receive time not stored: %d", events[0].ev.Received)
+	}
+}
+
+//
+//  skewedtrip -- events from a script whose clock is a day behind, with
+//  one event where the clock jumped ahead
+//
+func skewedtrip(tripid string) []tripevent {
+	const start = 1521350914 // server time of first event
+	const behind = 86400     // client clock error
+	var events []tripevent
+	for i, dt := range []int64{0, 100, 200, 300} {
+		hdr, ev := testevent(tripid, int32(i))
+		ev.Received = start + dt
+		ev.Timestamp = start + dt - behind
+		if i == 2 {
+			ev.Timestamp = start + dt + 5000 // clock jump
+		}
+		ev.Suspect = skewlimit.outside(ev.Received - ev.Timestamp)
+		if i == 3 {
+			ev.Eventtype = "SHUTDOWN"
+		}
+		events = append(events, tripevent{hdr: hdr, ev: ev})
+	}
+	return events
+}
+
+func TestClockSkewSummary(t *testing.T) {
+	store := newmemstore()
+	tripid := GenerateRandomTripid()
+	events := skewedtrip(tripid)
+	if _, err := store.appendevents(events, usednonce{}); err != nil {
+		t.Fatal(err)
+	}
+	store.now = func() time.Time { return time.Now().Add(time.Hour) }
+	if n, err := dosummarize(store, "test", false); n != 1 || err != nil {
+		t.Fatalf("Summarized %d trips, err %v, expected 1", n, err)
+	}
+	r, err := store.loadtripsummary(tripid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.clock_skew != 86400 {
+		t.Errorf("clock_skew: got %d, expected 86400", r.clock_skew)
+	}
+	if r.suspect_events != 4 {
+		t.Errorf("suspect_events: got %d, expected 4", r.suspect_events)
+	}
+	if r.elapsed != 300 {
+		t.Errorf("elapsed: got %d, expected 300", r.elapsed)
+	}
+	//  Jumped event gets its receive time
+	if ct := correctedtime(events[2].ev, 86400); ct != events[2].ev.Received {
+		t.Errorf("Corrected time of jumped event: got %d, expected %d", ct, events[2].ev.Received)
+	}
+}
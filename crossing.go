@@ -0,0 +1,231 @@
+//
+//  crossing -- region crossing analysis
+//
+//  The vehicle script logs CROSSSPEED, with its speed in auxval, just
+//  after it enters a region, and CROSSEND, with the time the crossing
+//  took in auxval, once the simulator has handed it over. The summarizer
+//  pairs them into crossings, and the crossings are totaled by boundary
+//  to find the region boundaries where vehicles have the most trouble.
+//
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+//
+//  Constants
+//
+const defaultmincrossings = 5 // boundaries with fewer crossings aren't ranked
+const defaultworst = 20       // boundaries in report
+
+//
+//  crossing -- one region crossing, a row of the crossings table
+//
+//  A boundary is the pair of region corners either side of it, lower
+//  corner first, so crossings in both directions count together.
+//
+type crossing struct {
+	tripid    string   // ID of trip
+	seq       int32    // 0 for the first crossing of the trip, then in order
+	grid      string   // grid name
+	region_a  slregion // region on one side of the boundary
+	region_b  slregion // region on the other side
+	stamp     int64    // CROSSSPEED time, UNIX, client time
+	speed     float64  // at crossing, meters/sec
+	duration  float64  // time the crossing took, secs; 0 if never completed
+	pos_error float64  // how far distance moved during crossing is off from that expected at crossing speed, meters
+	complete  bool     // CROSSEND received
+}
+
+//
+//  boundarystat -- crossings of one region boundary
+//
+type boundarystat struct {
+	grid          string   // grid name
+	region_a      slregion // region on one side of the boundary
+	region_b      slregion // region on the other side
+	crossings     int      // times crossed
+	incomplete    int      // crossings which never got a CROSSEND
+	mean_duration float64  // of completed crossings, secs
+	max_duration  float64  // of completed crossings, secs
+	mean_speed    float64  // at crossing, meters/sec
+	mean_error    float64  // position error of completed crossings, meters
+	max_error     float64  // position error of completed crossings, meters
+}
+
+//
+//  failrate -- fraction of crossings never completed
+//
+func (st boundarystat) failrate() float64 {
+	if st.crossings == 0 {
+		return 0
+	}
+	return float64(st.incomplete) / float64(st.crossings)
+}
+
+//
+//  worse -- true if boundary a ranks worse than b
+//
+//  Crossings which never complete are the worst trouble, then slow ones.
+//  Ties go in boundary order, so reports are repeatable.
+//
+func worse(a boundarystat, b boundarystat) bool {
+	if a.failrate() != b.failrate() {
+		return a.failrate() > b.failrate()
+	}
+	if a.mean_duration != b.mean_duration {
+		return a.mean_duration > b.mean_duration
+	}
+	if a.grid != b.grid {
+		return a.grid < b.grid
+	}
+	if a.region_a != b.region_a {
+		return cornerless(a.region_a, b.region_a)
+	}
+	return cornerless(a.region_b, b.region_b)
+}
+
+func cornerless(a slregion, b slregion) bool {
+	return a.X < b.X || (a.X == b.X && a.Y < b.Y)
+}
+
+//
+//  updatecrossings -- pair CROSSSPEED and CROSSEND events into crossings
+//
+//  A CROSSSPEED starts a crossing from the region the vehicle was in
+//  before this one. Other events may be logged in the new region first.
+//  The next CROSSEND completes it, unless another CROSSSPEED comes first.
+//
+func (r *trip) updatecrossings(event vehlogevent, hdr slheader, gpos slglobalpos) {
+	if hdr.Region != r.region {
+		r.fromregion, r.region = r.region, hdr.Region
+		r.crossed = false
+	}
+	switch event.Eventtype {
+	case "CROSSSPEED":
+		r.crosspending = false
+		if r.fromregion.Name == "" || r.crossed { // no boundary crossed
+			return
+		}
+		r.crossed = true
+		a, b := r.fromregion, hdr.Region
+		if cornerless(b, a) {
+			a, b = b, a
+		}
+		r.sx.crossings = append(r.sx.crossings, crossing{tripid: event.Tripid, seq: int32(len(r.sx.crossings)),
+			grid: hdr.Grid, region_a: a, region_b: b, stamp: event.Timestamp, speed: float64(event.Auxval)})
+		r.crosspending = true
+		r.crosspos = gpos
+	case "CROSSEND":
+		if !r.crosspending {
+			return
+		}
+		c := &r.sx.crossings[len(r.sx.crossings)-1]
+		c.complete = true
+		c.duration = float64(event.Auxval)
+		c.pos_error = math.Abs(r.crosspos.Distance(gpos) - c.speed*c.duration)
+		r.crosspending = false
+	}
+}
+
+//
+//  boundarytotals -- crossings totaled by boundary, worst first
+//
+//  Boundaries with fewer than mincrossings crossings are left out. At most
+//  limit boundaries; 0 for no limit. The SQL store does this in SQL.
+//
+func boundarytotals(crossings []crossing, mincrossings int, limit int) []boundarystat {
+	type boundarykey struct {
+		grid     string
+		region_a slregion
+		region_b slregion
+	}
+	bykey := make(map[boundarykey]*boundarystat)
+	for _, c := range crossings {
+		k := boundarykey{c.grid, slregion{X: c.region_a.X, Y: c.region_a.Y}, slregion{X: c.region_b.X, Y: c.region_b.Y}}
+		st := bykey[k]
+		if st == nil {
+			st = &boundarystat{grid: c.grid, region_a: c.region_a, region_b: c.region_b}
+			bykey[k] = st
+		}
+		st.crossings++
+		st.mean_speed += c.speed // sums until the end
+		if !c.complete {
+			st.incomplete++
+			continue
+		}
+		st.mean_duration += c.duration
+		st.mean_error += c.pos_error
+		st.max_duration = math.Max(st.max_duration, c.duration)
+		st.max_error = math.Max(st.max_error, c.pos_error)
+	}
+	var stats []boundarystat
+	for _, st := range bykey {
+		if st.crossings < mincrossings {
+			continue
+		}
+		st.mean_speed /= float64(st.crossings)
+		if completed := st.crossings - st.incomplete; completed > 0 {
+			st.mean_duration /= float64(completed)
+			st.mean_error /= float64(completed)
+		}
+		stats = append(stats, *st)
+	}
+	sort.Slice(stats, func(i, j int) bool { return worse(stats[i], stats[j]) })
+	if limit > 0 && len(stats) > limit {
+		stats = stats[:limit]
+	}
+	return stats
+}
+
+//
+//  printboundaries -- report of boundary stats, worst first
+//
+func printboundaries(out io.Writer, stats []boundarystat) {
+	if len(stats) == 0 {
+		fmt.Fprintf(out, "No boundaries with enough crossings.\n")
+		return
+	}
+	fmt.Fprintf(out, "%-20s %-40s %9s %7s %8s %8s %8s %8s %8s\n",
+		"Grid", "Boundary", "Crossings", "Failed", "Mean s", "Max s", "Speed", "Error m", "Max m")
+	for _, st := range stats {
+		fmt.Fprintf(out, "%-20s %-40s %9d %7d %8.3f %8.3f %8.2f %8.2f %8.2f\n",
+			st.grid, st.region_a.Name+" / "+st.region_b.Name, st.crossings, st.incomplete,
+			st.mean_duration, st.max_duration, st.mean_speed, st.mean_error, st.max_error)
+	}
+}
+
+//
+//  crossingscommand -- "vehiclelogserver crossings [flags]"
+//
+func crossingscommand(args []string) error {
+	flags := flag.NewFlagSet("crossings", flag.ContinueOnError)
+	cfile := flags.String("config", configloc, "configuration file")
+	grid := flags.String("grid", "", "boundaries on this grid; all grids if not given")
+	mincrossings := flags.Int("min", defaultmincrossings, "leave out boundaries crossed fewer times")
+	worst := flags.Int("worst", defaultworst, "report this many boundaries; 0 for all")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *mincrossings < 1 || *worst < 0 {
+		return errors.New("-min must be at least 1, and -worst not negative")
+	}
+	sv := new(FastCGIServer)
+	if err := initdb(*cfile, sv); err != nil {
+		return err
+	}
+	defer sv.store.close()
+	stats, err := sv.store.boundarystats(*grid, *mincrossings, *worst)
+	if err != nil {
+		return err
+	}
+	printboundaries(os.Stdout, stats)
+	return nil
+}
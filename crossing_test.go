@@ -0,0 +1,107 @@
+//
+//  Tests for region crossing analysis
+//
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCrossingPairs(t *testing.T) {
+	a := slregion{Name: "Vallone", X: 462592, Y: 306944}
+	b := slregion{Name: "Jeogeot", X: 462848, Y: 306944} // east of a
+	steps := []struct {
+		eventtype string
+		region    slregion
+		x         float32 // local position
+		auxval    float32
+	}{
+		{"STARTUP", a, 200, 0},
+		{"CROSSSPEED", b, 1, 10},  // into b at 10 m/s
+		{"CROSSEND", b, 1.5, 0.1}, // 0.5m in 0.1s, expected 1m
+		{"SLOW", b, 10, 5},
+		{"CROSSSPEED", a, 250, 8}, // back into a, never completed
+		{"CROSSSPEED", b, 2, 12},  // and out again
+		{"CROSSEND", b, 3.2, 0.1},
+		{"CROSSEND", b, 4, 0.2}, // no crossing to end
+	}
+	var tr trip
+	for i, step := range steps {
+		hdr, ev := testevent("x", int32(i))
+		hdr.Region = step.region
+		hdr.Local_position = slvector{X: step.x, Y: 128}
+		ev.Eventtype, ev.Auxval = step.eventtype, step.auxval
+		tr.updatefromevent(ev, hdr, i == 0)
+	}
+	crossings := tr.sx.crossings
+	if len(crossings) != 3 {
+		t.Fatalf("Got %d crossings, expected 3: %v", len(crossings), crossings)
+	}
+	for i, c := range crossings {
+		if c.seq != int32(i) || c.region_a != a || c.region_b != b || c.grid != "Production" {
+			t.Errorf("Crossing %d: seq %d, boundary %v / %v, grid %s", i, c.seq, c.region_a, c.region_b, c.grid)
+		}
+	}
+	if c := crossings[0]; !c.complete || c.speed != 10 || math.Abs(c.duration-0.1) > 1e-6 || math.Abs(c.pos_error-0.5) > 1e-4 {
+		t.Errorf("First crossing: complete %v, speed %f, duration %f, error %f", c.complete, c.speed, c.duration, c.pos_error)
+	}
+	if c := crossings[1]; c.complete || c.duration != 0 {
+		t.Errorf("Second crossing: complete %v, duration %f, expected incomplete", c.complete, c.duration)
+	}
+	if c := crossings[2]; !c.complete || math.Abs(c.duration-0.1) > 1e-6 {
+		t.Errorf("Third crossing: complete %v, duration %f", c.complete, c.duration)
+	}
+	stats := boundarytotals(crossings, 1, 0)
+	if len(stats) != 1 {
+		t.Fatalf("Got %d boundaries, expected 1", len(stats))
+	}
+	if st := stats[0]; st.crossings != 3 || st.incomplete != 1 || math.Abs(st.mean_speed-10) > 1e-6 || math.Abs(st.mean_duration-0.1) > 1e-6 {
+		t.Errorf("Boundary: %d crossings, %d incomplete, mean speed %f, mean duration %f", st.crossings, st.incomplete, st.mean_speed, st.mean_duration)
+	}
+	if stats := boundarytotals(crossings, 4, 0); len(stats) != 0 {
+		t.Errorf("Boundary with too few crossings reported")
+	}
+}
+
+//
+//  checktestcrossings -- check crossings of the trip in testdata.txt, and the boundary report
+//
+func checktestcrossings(t *testing.T, store vehstore, r tripsummary) {
+	crossings, err := store.tripcrossings(r.tripid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crossings) != 108 {
+		t.Errorf("Got %d crossings, expected 108", len(crossings))
+	}
+	for _, c := range crossings {
+		if !c.complete || c.duration <= 0 || c.speed <= 0 || cornerless(c.region_b, c.region_a) {
+			t.Errorf("Crossing %d: %v", c.seq, c)
+		}
+	}
+	stats, err := store.boundarystats("Production", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := boundarytotals(crossings, 1, 0)
+	if len(stats) != len(expected) {
+		t.Fatalf("Store reported %d boundaries, expected %d", len(stats), len(expected))
+	}
+	for i := range stats {
+		st, ex := stats[i], expected[i]
+		if st.region_a != ex.region_a || st.region_b != ex.region_b || st.crossings != ex.crossings ||
+			math.Abs(st.mean_duration-ex.mean_duration) > 1e-4 || math.Abs(st.max_error-ex.max_error) > 1e-3 {
+			t.Errorf("Boundary %d: got %v, expected %v", i, st, ex)
+		}
+		if i > 0 && worse(st, stats[i-1]) {
+			t.Errorf("Boundary %d ranks worse than boundary %d", i, i-1)
+		}
+	}
+	if stats, err := store.boundarystats("Production", 1, 3); err != nil || len(stats) != 3 {
+		t.Errorf("Limited report: %d boundaries, err %v", len(stats), err)
+	}
+	if stats, err := store.boundarystats("OSGrid", 1, 0); err != nil || len(stats) != 0 {
+		t.Errorf("Other grid: %d boundaries, err %v", len(stats), err)
+	}
+}
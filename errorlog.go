@@ -0,0 +1,253 @@
+//
+//  errorlog -- record ingest and summarizer failures in the errorlog table
+//
+//  Entries are rate limited per source, so one broken vehicle script
+//  can't flood the table. The source is the authenticated owner key, or,
+//  for requests which fail authentication or have a bad header, the
+//  address they came from, since their owner headers can't be trusted.
+//  Behind a reverse proxy every request comes from the proxy's address,
+//  so set "Errorlog": {"Forwardedfor": "X-Forwarded-For"}, or whatever
+//  header the proxy puts the client address in, to limit by that instead.
+//  Only do this if the proxy is ours; a client can send the header too.
+//  Messages are cut off at maxerrormsg bytes.
+//
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+//
+//  Constants
+//
+const defaulterrorsperowner = 20 // errorlog entries per source per window
+const defaulterrorwindowsecs = 300
+const maxerrorowners = 10000 // prune rate limit table beyond this
+const maxerrormsg = 1000     // longer messages are cut off
+const categorysummarize = "summarize"
+const categoryretiredkey = "retired_key" // retired auth key version used
+const defaulterrors = 50                 // entries in report
+
+//
+//  errorcount -- errors from one source in the current window
+//
+type errorcount struct {
+	start      time.Time // start of window
+	n          int       // entries logged in window
+	suppressed int       // entries dropped in window
+}
+
+//
+//  errorlimiter -- per-source rate limit on errorlog entries
+//
+type errorlimiter struct {
+	mu     sync.Mutex
+	max    int                    // entries per window
+	window time.Duration          // window length
+	owners map[string]*errorcount // by source, from ownersource or requestsource
+}
+
+func newerrorlimiter(max int, windowsecs int) *errorlimiter {
+	if max <= 0 {
+		max = defaulterrorsperowner
+	}
+	if windowsecs <= 0 {
+		windowsecs = defaulterrorwindowsecs
+	}
+	return &errorlimiter{max: max, window: time.Duration(windowsecs) * time.Second, owners: make(map[string]*errorcount)}
+}
+
+//
+//  allow -- should this source's error be logged?
+//
+//  Also returns the number dropped in the source's previous window, to be reported.
+//
+func (l *errorlimiter) allow(owner string, now time.Time) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := l.owners[owner]
+	if c == nil || now.Sub(c.start) >= l.window { // new window
+		suppressed := 0
+		if c != nil {
+			suppressed = c.suppressed
+		}
+		if len(l.owners) >= maxerrorowners {
+			l.prune(now)
+		}
+		l.owners[owner] = &errorcount{start: now, n: 1}
+		return true, suppressed
+	}
+	if c.n >= l.max {
+		c.suppressed++
+		return false, 0
+	}
+	c.n++
+	return true, 0
+}
+
+//
+//  prune -- drop owners whose window is over. Caller holds lock.
+//
+func (l *errorlimiter) prune(now time.Time) {
+	for owner, c := range l.owners {
+		if now.Sub(c.start) >= l.window {
+			delete(l.owners, owner)
+		}
+	}
+}
+
+//
+//  errorlimit -- the rate limiter for this process. Set from config by initserver.
+//
+var errorlimit = newerrorlimiter(0, 0)
+
+//
+//  forwardedfor -- header our reverse proxy puts the client address in, if any. Set from config by initserver.
+//
+var forwardedfor string
+
+//
+//  ownersource -- rate limit source for errors of an authenticated owner
+//
+func ownersource(owner_key string) string {
+	return "owner " + owner_key
+}
+
+//
+//  requestsource -- rate limit source for a failed request
+//
+//  Owner headers are only trusted once the request has been authenticated
+//  and its header parsed.
+//
+func requestsource(req *http.Request, err error) string {
+	switch err.(type) {
+	case *autherror, *headererror:
+		return "address " + clientaddress(req)
+	}
+	return ownersource(strings.ToLower(strings.TrimSpace(req.Header.Get("X-Secondlife-Owner-Key"))))
+}
+
+//
+//  clientaddress -- address a request came from, as seen by our reverse proxy if there is one
+//
+//  The proxy appends the address it got the request from, so the last
+//  entry of the forwarded-for list is the one to trust.
+//
+func clientaddress(req *http.Request) string {
+	if forwardedfor != "" {
+		addrs := strings.Split(req.Header.Get(forwardedfor), ",")
+		if addr := strings.TrimSpace(addrs[len(addrs)-1]); addr != "" {
+			return addr
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+//
+//  requestowner -- owner name to log for a failed request
+//
+//  Empty if the request failed auth or its header didn't parse, as the
+//  owner name header can't be trusted then, and anyone could otherwise
+//  put errorlog entries under any owner's name.
+//
+func requestowner(req *http.Request, err error) string {
+	switch err.(type) {
+	case *autherror, *headererror:
+		return ""
+	}
+	return strings.TrimSpace(req.Header.Get("X-Secondlife-Owner-Name"))
+}
+
+//
+//  truncatemsg -- cut off a long message, on a character boundary
+//
+func truncatemsg(msg string) string {
+	if len(msg) <= maxerrormsg {
+		return msg
+	}
+	n := maxerrormsg
+	for n > 0 && !utf8.RuneStart(msg[n]) {
+		n--
+	}
+	return msg[:n] + "..."
+}
+
+//
+//  recorderror -- add an entry to the error log, subject to rate limit for its source
+//
+//  Failure to log is only reported locally; it must not fail the request.
+//
+func recorderror(store vehstore, source string, e errorlogentry) {
+	ok, suppressed := errorlimit.allow(source, servernow())
+	if !ok {
+		return
+	}
+	e.msg = truncatemsg(e.msg)
+	if suppressed > 0 {
+		e.msg = fmt.Sprintf("%s [%d earlier errors from this source not logged]", e.msg, suppressed)
+	}
+	if len(e.tripid) != 40 { // not a trip ID, don't store
+		e.tripid = ""
+	}
+	err := store.logerror(e)
+	if err != nil {
+		log.Printf("Unable to log error \"%s\": %s", e.msg, err)
+	}
+}
+
+//
+//  printerrors -- report of errorlog entries, newest first
+//
+func printerrors(out io.Writer, entries []errorlogentry) {
+	if len(entries) == 0 {
+		fmt.Fprintf(out, "No errors.\n")
+		return
+	}
+	for _, e := range entries {
+		fmt.Fprintf(out, "%s %-12s %-24s %-40s %s\n",
+			e.stamp.UTC().Format(time.RFC3339), e.category, e.owner_name, e.tripid, e.msg)
+	}
+}
+
+//
+//  errorscommand -- "vehiclelogserver errors [flags]"
+//
+func errorscommand(args []string) error {
+	flags := flag.NewFlagSet("errors", flag.ContinueOnError)
+	cfile := flags.String("config", configloc, "configuration file")
+	owner := flags.String("owner", "", "errors for this owner name; all owners if not given")
+	tripid := flags.String("tripid", "", "errors for this trip")
+	limit := flags.Int("limit", defaulterrors, "report this many errors, newest first")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *limit < 1 {
+		return errors.New("-limit must be at least 1")
+	}
+	sv := new(FastCGIServer)
+	if err := initdb(*cfile, sv); err != nil {
+		return err
+	}
+	defer sv.store.close()
+	entries, err := sv.store.recenterrors(*owner, *tripid, *limit)
+	if err != nil {
+		return err
+	}
+	printerrors(os.Stdout, entries)
+	return nil
+}
@@ -0,0 +1,193 @@
+//
+//  Tests for error logging
+//
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestErrorLogIngest(t *testing.T) {
+	sv := newtestserver(t)
+	tripid := GenerateRandomTripid()
+	testjson := []byte(strings.Replace(testjson1, "TRIPID", tripid, 1))
+	hdr := signedheader(testjson)
+	hdr.Set("X-Authtoken-Hash", "0000000000000000000000000000000000000000")
+	postevent(t, sv, testjson, hdr)
+	entries, err := sv.store.recenterrors("", tripid, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].category != statusbadauth || entries[0].tripid != tripid {
+		t.Errorf("Rejected event not logged: %+v", entries)
+	}
+	//  Owner name of a request failing auth isn't trusted
+	if len(entries) == 1 && entries[0].owner_name != "" {
+		t.Errorf("Failed auth logged under claimed owner \"%s\"", entries[0].owner_name)
+	}
+	if entries, _ = sv.store.recenterrors("animats Resident", "", 10); len(entries) != 0 {
+		t.Errorf("Got %d entries for claimed owner, expected 0", len(entries))
+	}
+	//  Good events aren't logged
+	postevent(t, sv, testjson, signedheader(testjson))
+	entries, _ = sv.store.recenterrors("", tripid, 10)
+	if len(entries) != 1 {
+		t.Errorf("Expected 1 entry for trip, got %d", len(entries))
+	}
+}
+
+func TestErrorLogRateLimit(t *testing.T) {
+	config := testcfg
+	config.Errorlog.Maxperowner = 3
+	sv := new(FastCGIServer)
+	if err := initserver(config, sv); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { errorlimit = newerrorlimiter(0, 0) }()
+	testjson := []byte(strings.Replace(testjson1, "TRIPID", "TOOSHORT", 1))
+	for i := 0; i < 10; i++ {
+		postevent(t, sv, testjson, signedheader(testjson))
+	}
+	entries, _ := sv.store.recenterrors("animats Resident", "", 100)
+	if len(entries) != 3 {
+		t.Errorf("Got %d entries for flooding owner, expected 3", len(entries))
+	}
+	//  Other owners are not affected, but a name alone doesn't make another owner
+	hdr := signedheader(testjson)
+	hdr.Set("X-Secondlife-Owner-Name", "Someone Else")
+	postevent(t, sv, testjson, hdr)
+	hdr.Set("X-Secondlife-Owner-Name", "Someone Else Again")
+	hdr.Set("X-Secondlife-Owner-Key", "0e9ebf4b-0d3a-4b5a-9f4e-1b7e1f4a6c11")
+	postevent(t, sv, testjson, hdr)
+	if entries, _ = sv.store.recenterrors("Someone Else", "", 100); len(entries) != 0 {
+		t.Errorf("Got %d entries for other owner name with flooding owner's key, expected 0", len(entries))
+	}
+	if entries, _ = sv.store.recenterrors("Someone Else Again", "", 100); len(entries) != 1 {
+		t.Errorf("Got %d entries for other owner, expected 1", len(entries))
+	}
+}
+
+func TestErrorLogBadAuthFlood(t *testing.T) {
+	config := testcfg
+	config.Errorlog.Maxperowner = 3
+	sv := new(FastCGIServer)
+	if err := initserver(config, sv); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { errorlimit = newerrorlimiter(0, 0) }()
+	testjson := []byte(strings.Replace(testjson1, "TRIPID", GenerateRandomTripid(), 1))
+	hdr := signedheader(testjson)
+	hdr.Set("X-Authtoken-Hash", "0000000000000000000000000000000000000000")
+	for i := 0; i < 10; i++ { // a different claimed owner each time
+		hdr.Set("X-Secondlife-Owner-Name", fmt.Sprintf("Forger %d", i))
+		postevent(t, sv, testjson, hdr)
+	}
+	entries, _ := sv.store.recenterrors("", "", 100)
+	if len(entries) != 3 {
+		t.Errorf("Got %d entries for failed auth from one address, expected 3", len(entries))
+	}
+	for _, e := range entries {
+		if strings.Contains(e.msg, "John Doe") {
+			t.Errorf("Request body in errorlog message: %s", e.msg)
+		}
+	}
+}
+
+func TestErrorLogForwardedFor(t *testing.T) {
+	config := testcfg
+	config.Errorlog.Maxperowner = 3
+	config.Errorlog.Forwardedfor = "X-Forwarded-For"
+	sv := new(FastCGIServer)
+	if err := initserver(config, sv); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { errorlimit, forwardedfor = newerrorlimiter(0, 0), "" }()
+	testjson := []byte(strings.Replace(testjson1, "TRIPID", GenerateRandomTripid(), 1))
+	hdr := signedheader(testjson)
+	hdr.Set("X-Authtoken-Hash", "0000000000000000000000000000000000000000")
+	for _, client := range []string{"192.0.2.1", "192.0.2.2"} { // through one proxy
+		hdr.Set("X-Forwarded-For", "10.1.1.1, "+client) // first one is from the client, not trusted
+		for i := 0; i < 10; i++ {
+			postevent(t, sv, testjson, hdr)
+		}
+	}
+	if entries, _ := sv.store.recenterrors("", "", 100); len(entries) != 6 {
+		t.Errorf("Got %d entries for failed auth from two clients, expected 6", len(entries))
+	}
+}
+
+func TestTruncateMsg(t *testing.T) {
+	long := strings.Repeat("x", maxerrormsg-1) + "\u00e9\u00e9"
+	if msg := truncatemsg(long); len(msg) != maxerrormsg-1+len("...") || !utf8.ValidString(msg) {
+		t.Errorf("Truncated to %d bytes, valid UTF-8 %v", len(msg), utf8.ValidString(msg))
+	}
+	if msg := truncatemsg("short"); msg != "short" {
+		t.Errorf("Short message changed to \"%s\"", msg)
+	}
+}
+
+func TestErrorLimiterWindow(t *testing.T) {
+	l := newerrorlimiter(2, 60)
+	now := time.Now()
+	for i, expected := range []bool{true, true, false, false} {
+		if ok, _ := l.allow("owner", now); ok != expected {
+			t.Errorf("Error %d: allow %v, expected %v", i, ok, expected)
+		}
+	}
+	ok, suppressed := l.allow("owner", now.Add(61*time.Second)) // next window
+	if !ok || suppressed != 2 {
+		t.Errorf("New window: allow %v, suppressed %d, expected true, 2", ok, suppressed)
+	}
+}
+
+//
+//  failsummarystore -- a store which can't write trip summaries
+//
+type failsummarystore struct {
+	*memstore
+}
+
+func (s failsummarystore) writetripsummary(worker string, r tripsummary) error {
+	return errors.New("injected failure")
+}
+
+func TestErrorLogSummarize(t *testing.T) {
+	ms := newmemstore()
+	store := failsummarystore{ms}
+	tripid := GenerateRandomTripid()
+	hdr, ev := testevent(tripid, 0)
+	mustappend(t, store, hdr, ev)
+	ms.now = func() time.Time { return time.Now().Add(time.Hour) }
+	if _, err := dosummarize(store, "test", false); err == nil {
+		t.Fatalf("Injected failure not reported")
+	}
+	entries, _ := store.recenterrors("", tripid, 10)
+	if len(entries) != 1 || entries[0].category != categorysummarize || entries[0].owner_name != hdr.Owner_name {
+		t.Errorf("Summarizer failure not logged: %+v", entries)
+	}
+}
+
+func TestErrorLogSQLite(t *testing.T) {
+	s, cleanup := newtestsqlitestore(t)
+	defer cleanup()
+	tripid := GenerateRandomTripid()
+	recorderror(s, ownersource("dadec334-539a-4875-ad0e-d9654705f437"), errorlogentry{owner_name: "animats Resident", tripid: tripid, category: statusbadjson, msg: "first"})
+	recorderror(s, ownersource("dadec334-539a-4875-ad0e-d9654705f437"), errorlogentry{owner_name: "animats Resident", category: statusbadauth, msg: "second"})
+	recorderror(s, ownersource("0e9ebf4b-0d3a-4b5a-9f4e-1b7e1f4a6c11"), errorlogentry{owner_name: "Someone Else", category: statusbadauth, msg: "third"})
+	entries, err := s.recenterrors("animats Resident", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Got %d entries for owner, expected 2", len(entries))
+	}
+	entries, _ = s.recenterrors("", tripid, 10)
+	if len(entries) != 1 || entries[0].msg != "first" || entries[0].category != statusbadjson {
+		t.Errorf("Got %+v for trip", entries)
+	}
+}
@@ -7,19 +7,17 @@
 //
 //  TODO:
 //  - Add JSON fields "echo", "timestamp", and "serial", in client and server. [DONE]
-//  - Add clock skew check for timestamp.
-//  - Add logging of grid
+//  - Add clock skew check for timestamp. [DONE]
+//  - Add logging of grid [DONE]
 //
 package main
 
 import (
 	"crypto/sha1" // cryptograpically weak, but SL still uses it
-	"database/sql"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	_ "github.com/go-sql-driver/mysql"
 	"io/ioutil"
 	"math"
 	"net/http"
@@ -43,6 +41,17 @@ func (v slvector) String() string {
 	return fmt.Sprintf("(%f,%f,%f)", v.X, v.Y, v.Z)
 }
 
+type slquaternion struct { // SL rotation, <x, y, z, s>
+	X float32
+	Y float32
+	Z float32
+	S float32
+}
+
+func (q slquaternion) String() string {
+	return fmt.Sprintf("(%f,%f,%f,%f)", q.X, q.Y, q.Z, q.S)
+}
+
 type slregion struct { // region corners, always integer meters
 	Name string
 	X    int32
@@ -56,23 +65,44 @@ func (r slregion) String() string {
 type slglobalpos struct {
 	X float64
 	Y float64
+	Z float64 // altitude, same as local Z. Negative if unknown, as for trips summarized before altitude was kept.
 }
 
 func (r *slglobalpos) Set(region slregion, pos slvector) {
 	r.X = float64(region.X) + float64(pos.X) // region corner plus local offset
 	r.Y = float64(region.Y) + float64(pos.Y)
+	r.Z = float64(pos.Z)
+}
+
+//
+//  knownz -- true if altitude is known
+//
+//  Events always had Z, but trips and segments stored before altitude was
+//  summarized read back with the column default, -1.
+//
+func (r slglobalpos) knownz() bool {
+	return r.Z >= 0
 }
 
 func (r *slglobalpos) Min(t slglobalpos) {
 	r.X = math.Min(r.X, t.X)
 	r.Y = math.Min(r.Y, t.Y)
+	if t.knownz() && (!r.knownz() || t.Z < r.Z) { // unknown altitudes don't count
+		r.Z = t.Z
+	}
 }
 
 func (r *slglobalpos) Max(t slglobalpos) {
 	r.X = math.Max(r.X, t.X)
 	r.Y = math.Max(r.Y, t.Y)
+	if t.knownz() && t.Z > r.Z {
+		r.Z = t.Z
+	}
 }
 
+//
+//  Distance -- horizontal distance. Altitude changes are checked by updatefalls.
+//
 func (r *slglobalpos) Distance(t slglobalpos) float64 {
 	dx := r.X - t.X
 	dy := r.Y - t.Y
@@ -88,6 +118,8 @@ func (r *slglobalpos) Distance(t slglobalpos) float64 {
 //  "X-Secondlife-Region" : {"Vallone (462592, 306944)"},
 //  "X-Authtoken-Value" : {"0bc935dbb51aaeaf2ae0e98362d3b7500db36350"},
 //  "X-Secondlife-Local-Position" : {"(204.783539, 26.682831, 35.563702)"},
+//  "X-Secondlife-Local-Velocity" : {"(0.000000, 0.000000, 0.000000)"},
+//  "X-Secondlife-Local-Rotation" : {"(0.000000, 0.000000, 0.000000, 1.000000)"},
 //  "X-Authtoken-Name" : {"TEST"},
 
 //  Typical JSON from our logger
@@ -95,15 +127,20 @@ func (r *slglobalpos) Distance(t slglobalpos) float64 {
 //  "{\"tripid\":\"ABCDEF\",\"severity\":2,\"type\":\"STARTUP\",\"msg\":\"John Doe\",\"auxval\":1.0}"
 
 type slheader struct {
-	Owner_name     string   // name of owner
-	Shard          string   // which grid
-	Object_name    string   // object name
-	Region         slregion // SL region name and corner
-	Local_position slvector // position within region
+	Owner_name     string       // name of owner, which can change
+	Owner_key      string       // owner UUID, lower case
+	Shard          string       // server shard, if sent
+	Grid           string       // which grid, from Parsegrid
+	Object_name    string       // object name, which can change, and many objects share
+	Object_key     string       // object UUID, lower case
+	Region         slregion     // SL region name and corner
+	Local_position slvector     // position within region
+	Local_velocity slvector     // velocity, region axes, meters/sec
+	Local_rotation slquaternion // rotation, region axes. All zero if not sent.
 }
 
 func (r slheader) String() string {
-	return fmt.Sprintf("owner_name: \"%s\"  object_name: \"%s\"  region: %s  local_position: %s", r.Owner_name, r.Object_name, r.Region, r.Local_position)
+	return fmt.Sprintf("owner_name: \"%s\"  object_name: \"%s\"  grid: \"%s\"  region: %s  local_position: %s", r.Owner_name, r.Object_name, r.Grid, r.Region, r.Local_position)
 }
 
 type vehlogevent struct {
@@ -115,6 +152,9 @@ type vehlogevent struct {
 	Msg       string  // human-readable message
 	Auxval    float32 // some other value associated with the event
 	Debug     int8    // logging level
+	Received  int64   `json:"-"` // UNIX timestamp, server side
+	Suspect   bool    `json:"-"` // client timestamp far from server time
+	Late      bool    `json:"-"` // arrived after its trip was summarized
 }
 
 //  Configuration info, from file
@@ -125,7 +165,51 @@ type vdbconfig struct {
 		User     string
 		Password string
 	}
-	Authkey map[string]string // auth keys
+	Store  string // storage backend: "mysql" (default), "sqlite", or "memory"
+	Sqlite struct {
+		Path string // SQLite database file
+	}
+	Authkey map[string]authkey // auth keys by name, each a secret or a secret with a policy
+	Grids   map[string]string  // grid name by shard, or by simulator host or domain from Via header
+	Server  struct {           // standalone mode, when not run under FastCGI
+		//  In fcgi mode the host may run many server processes, each summarizing,
+		//  so Adminlisten is only allowed with Summarizer.External, and is then
+		//  used by the "-mode summarize" process alone.
+		Mode         string // "fcgi" (default), "http", or "summarize"
+		Listen       string // address to listen on, such as ":8080"
+		Certfile     string // TLS certificate file; HTTPS if set
+		Keyfile      string // TLS private key file
+		Shutdownsecs int    // max time to drain requests on SIGTERM
+		Maxbody      int64  // max request body size, bytes
+		Adminlisten  string // address for admin requests, such as "localhost:8081". Never public.
+	}
+	Trips struct { // end of trip detection
+		Idlesecs    int // trip is over after no events for this long
+		Maxtripsecs int // summarize a trip still running after this long; 0 for no limit
+		Objects     []struct {
+			Pattern     string // object name pattern, as for path.Match, such as "Motorcycle*"
+			Idlesecs    int    // overrides, if not zero
+			Maxtripsecs int    // override, if not zero; -1 for no limit
+		}
+	}
+	Summarizer struct { // background summarization
+		Intervalsecs int  // look for finished trips every N seconds
+		External     bool // done by a separate "-mode summarize" process, not by the server
+		Leasesecs    int  // a worker's claim on a trip expires after this, if the worker dies
+	}
+	Clock struct { // limits on client clock error
+		Maxfuturesecs int64 // client timestamp this far ahead of server is suspect
+		Maxpastsecs   int64 // client timestamp this far behind server is suspect
+	}
+	Auth struct { // replay protection
+		Legacy     bool // also accept old signatures of the body alone, with no time or nonce
+		Maxagesecs int  // signed time this far from server time is rejected
+	}
+	Errorlog struct { // rate limit on errorlog entries
+		Maxperowner  int    // entries per owner key, or per address for requests failing auth, per window
+		Windowsecs   int    // window length
+		Forwardedfor string // header with client address, set by our reverse proxy; otherwise all requests through it share one limit
+	}
 }
 
 func (r vdbconfig) String() string {
@@ -189,14 +273,57 @@ func Parseslvector(s string) (slvector, error) {
 	return p, err
 }
 
+//  Parseslrotation - parse forms such as "(0.000000, 0.000000, 0.707107, 0.707107)"
+func Parseslrotation(s string) (slquaternion, error) {
+	var q slquaternion
+	_, err := fmt.Sscanf(s, "(%f,%f,%f,%f)", &q.X, &q.Y, &q.Z, &q.S)
+	return q, err
+}
+
 func Getheaderfield(headervars http.Header, key string) (string, error) {
 	s := strings.TrimSpace(headervars.Get(key))
 	if s == "" {
-		return s, errors.New(fmt.Sprintf("HTTP header from Second Life was missing field \"%s\"", key))
+		return s, &headererror{fmt.Errorf("HTTP header from Second Life was missing field \"%s\"", key)}
 	}
 	return s, nil
 }
 
+//
+//  isuuid -- true for the form "dadec334-539a-4875-ad0e-d9654705f437", either case
+//
+func isuuid(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+//
+//  Getheaderkey -- a UUID header field, in lower case
+//
+func Getheaderkey(headervars http.Header, key string) (string, error) {
+	s, err := Getheaderfield(headervars, key)
+	if err != nil {
+		return s, err
+	}
+	if !isuuid(s) {
+		return "", &headererror{fmt.Errorf("HTTP header field \"%s\" was \"%s\", not a key", key, s)}
+	}
+	return strings.ToLower(s), nil
+}
+
 func Parseheader(headervars http.Header) (slheader, error) {
 	var hdr slheader
 	var err error
@@ -204,23 +331,39 @@ func Parseheader(headervars http.Header) (slheader, error) {
 	if err != nil {
 		return hdr, err
 	}
+	hdr.Owner_key, err = Getheaderkey(headervars, "X-Secondlife-Owner-Key")
+	if err != nil {
+		return hdr, err
+	}
 	hdr.Object_name, err = Getheaderfield(headervars, "X-Secondlife-Object-Name")
 	if err != nil {
 		return hdr, err
 	}
-	hdr.Shard, err = Getheaderfield(headervars, "X-Secondlife-Shard")
+	hdr.Object_key, err = Getheaderkey(headervars, "X-Secondlife-Object-Key")
 	if err != nil {
 		return hdr, err
 	}
+	hdr.Shard = strings.TrimSpace(headervars.Get("X-Secondlife-Shard")) // not all grids send this
 	hdr.Region, err = Parseslregion(headervars.Get("X-Secondlife-Region"))
 	if err != nil {
-		return hdr, err
+		return hdr, &headererror{fmt.Errorf("Bad X-Secondlife-Region: %s", err)}
 	}
 	hdr.Local_position, err = Parseslvector(headervars.Get("X-Secondlife-Local-Position"))
 	if err != nil {
-		return hdr, err
+		return hdr, &headererror{fmt.Errorf("Bad X-Secondlife-Local-Position: %s", err)}
+	}
+	if s := headervars.Get("X-Secondlife-Local-Velocity"); s != "" { // OpenSimulator may not send these
+		hdr.Local_velocity, err = Parseslvector(s)
+		if err != nil {
+			return hdr, &headererror{fmt.Errorf("Bad X-Secondlife-Local-Velocity: %s", err)}
+		}
+	}
+	if s := headervars.Get("X-Secondlife-Local-Rotation"); s != "" {
+		hdr.Local_rotation, err = Parseslrotation(s)
+		if err != nil {
+			return hdr, &headererror{fmt.Errorf("Bad X-Secondlife-Local-Rotation: %s", err)}
+		}
 	}
-	////fmt.Printf("Parseheader: %s\n", hdr) // ***TEMP***
 	return hdr, nil
 }
 
@@ -228,10 +371,10 @@ func Parsevehevent(s []byte) (vehlogevent, error) {
 	var ev vehlogevent
 	err := json.Unmarshal(s, &ev) // decode JSON
 	if err != nil {
-		return ev, err
+		return ev, &eventerror{err}
 	}
 	if len(ev.Tripid) != 40 { // must be length of SHA1 hash in hex
-		return ev, errors.New(fmt.Sprintf("Trip ID \"%s\" from Second Life was not 40 bytes long", ev.Tripid))
+		return ev, &eventerror{fmt.Errorf("Trip ID \"%s\" from Second Life was not 40 bytes long", ev.Tripid)}
 	}
 	return ev, err
 }
@@ -246,109 +389,175 @@ func Hashwithtoken(token []byte, s []byte) string { // our SHA1 validation - mus
 //
 //  validateauthtoken -- validate that string has correct hash for auth token
 //
-func Validateauthtoken(s []byte, name string, value string, config vdbconfig) error {
-	token := config.Authkey[name] // get auth token
-	if token == "" {
-		return errors.New(fmt.Sprintf("Logging authorization token \"%s\" not recognized.", name))
+//  Returns which version of the token's secret matched.
+//
+func Validateauthtoken(s []byte, name string, value string, config vdbconfig) (authmatch, error) {
+	key := config.Authkey[name] // get auth token
+	if len(key.Versions) == 0 {
+		return authmatch{name: name}, &autherror{false, fmt.Errorf("Logging authorization token \"%s\" not recognized.", name)}
 	}
 	//  Do SHA1 check to validate that log entry is valid.
-	hash := Hashwithtoken([]byte(token), []byte(s))
-	if hash != value {
-		return errors.New(fmt.Sprintf("Logging authorization token \"%s\" failed to validate.\nText: \"%s\"\nHash sent: \"%s\"\nHash calc: \"%s\"",
-			name, s, value, hash))
-	}
-	return (nil)
+	return key.matchversion(name, s, value, servernow())
 }
 
-func insertevent(db *sql.DB, hdr slheader, ev vehlogevent) error {
-	const insstmt string = "INSERT INTO events  (time, shard, owner_name, object_name, region_name, region_corner_x, region_corner_y, local_position_x, local_position_y, local_position_z, tripid, severity, eventtype, msg, auxval, serial)  VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)"
-	_, err := db.Exec(insstmt,
-		ev.Timestamp,
-		hdr.Shard,
-		hdr.Owner_name,
-		hdr.Object_name,
-		hdr.Region.Name,
-		hdr.Region.X,
-		hdr.Region.Y,
-		hdr.Local_position.X,
-		hdr.Local_position.Y,
-		hdr.Local_position.Z,
-		ev.Tripid,
-		ev.Severity,
-		ev.Eventtype,
-		ev.Msg,
-		ev.Auxval,
-		ev.Serial)
-	return err
-}
+//
+//  Ingest status values, returned to the vehicle script
+//
+const (
+	statusok        = "ok"         // event stored
+	statusduplicate = "duplicate"  // identical event already stored
+	statusconflict  = "conflict"   // different event with same serial already stored
+	statusbadauth   = "bad_auth"   // signature or token name bad
+	statusbadheader = "bad_header" // X-Secondlife-* header missing or malformed
+	statusbadjson   = "bad_json"   // event not valid
+	statusdberror   = "db_error"   // could not store; retry later
+	statusinternal  = "internal"   // server bug
+)
 
 //
-//  inserttodo -- update to-do list of trips in progress
+//  ingestresponse -- JSON reply to every ingest request
 //
-func inserttodo(db *sql.DB, tripid string) error {
-	const insstmt string = "INSERT INTO tripstodo (tripid) VALUES (?) ON DUPLICATE KEY UPDATE stamp=NOW()"
-	_, err := db.Exec(insstmt, tripid)
-	return err
+type ingestresponse struct {
+	Status     string        `json:"status"`               // one of the status values
+	Serial     int32         `json:"serial"`               // echoed from event
+	Tripid     string        `json:"tripid"`               // echoed from event
+	Received   int64         `json:"received"`             // server receive time, UNIX
+	Msg        string        `json:"msg"`                  // human-readable message
+	Results    []batchresult `json:"results,omitempty"`    // per-event status, for a batch
+	Keyversion string        `json:"keyversion,omitempty"` // auth key version which signed the request, if it has versions
 }
 
 //
-//  dbupdate -- do the database updates to insert an event
+//  Addevent -- add an event to the database
+//
+//  Also returns which key version signed the event.
 //
-func dbupdate(db *sql.DB, hdr slheader, ev vehlogevent) error {
-	tx, err := db.Begin() // updating events and tripstodo
+func Addevent(bodycontent []byte, headervars http.Header, config vdbconfig, store vehstore) (authmatch, error) {
+	//  Validate auth token first
+	match, err := Authenticate(bodycontent, headervars, config)
 	if err != nil {
-		return err
+		return match, err
 	}
-	err = insertevent(db, hdr, ev)
-	if err == nil {
-		err = inserttodo(db, ev.Tripid)
-		if err == nil {
-			err = tx.Commit() // success
-			if err != nil {
-				return err
-			}
-
-		} // all OK, commit
+	hdr, err := Parseheader(headervars) // parse HTTP header
+	if err != nil {
+		return match, err
 	}
+	hdr.Grid, err = Parsegrid(headervars, hdr.Shard, config)
 	if err != nil {
-		_ = tx.Rollback() // fail, undo
+		return match, err
 	}
-	return err
+	err = Authorizekey(match.name, hdr, config, servernow()) // may this key log for this owner and object?
+	if err != nil {
+		return match, err
+	}
+	warnretired(store, match, hdr)
+	ev, err := Parsevehevent(bodycontent) // parse JSON from vehicle script
+	if err != nil {
+		return match, err
+	}
+	stampevent(&ev)                               // server time and clock check
+	err = store.appendevent(hdr, ev, match.nonce) // insert in database
+	nonces.prune(store, servernow())
+	switch err {
+	case errDuplicateEvent:
+		return match, resolveduplicate(store, hdr, ev)
+	case errReplayedNonce:
+		if isresend(store, []tripevent{{hdr: hdr, ev: ev}}) { // client never got the reply
+			return match, resolveduplicate(store, hdr, ev)
+		}
+		return match, &autherror{true, err}
+	}
+	return match, err
 }
 
 //
-//  Addevent -- add an event to the database
+//  isresend -- true if every event of a message is already stored
 //
-func Addevent(bodycontent []byte, headervars http.Header, config vdbconfig, db *sql.DB) error {
-	//  Validate auth token first
-	err := Validateauthtoken(bodycontent,
-		strings.TrimSpace(headervars.Get("X-Authtoken-Name")),
-		strings.TrimSpace(headervars.Get("X-Authtoken-Hash")),
-		config)
-	if err != nil {
-		return (err)
+//  A message whose nonce was used before is a replay, unless it is the
+//  same signed request sent again by a client which never got the reply.
+//  That is as harmless as any other resend. The signature covers the body,
+//  so each event is the one sent the first time. It was stored then, or it
+//  conflicted with a stored event then and conflicts with it again, so the
+//  caller reports the same status for it as before.
+//
+func isresend(store vehstore, events []tripevent) bool {
+	for _, te := range events {
+		if _, err := store.loadevent(te.ev.Tripid, te.ev.Serial); err != nil {
+			return false
+		}
 	}
-	hdr, err := Parseheader(headervars) // parse HTTP header
+	return true
+}
+
+//
+//  sameevent -- true if a resent event matches the stored one
+//
+func sameevent(a tripevent, b tripevent) bool {
+	return a.ev.Timestamp == b.ev.Timestamp && a.ev.Severity == b.ev.Severity &&
+		a.ev.Eventtype == b.ev.Eventtype && a.ev.Msg == b.ev.Msg && a.ev.Auxval == b.ev.Auxval &&
+		a.hdr.Owner_name == b.hdr.Owner_name && a.hdr.Object_name == b.hdr.Object_name &&
+		a.hdr.Owner_key == b.hdr.Owner_key && a.hdr.Object_key == b.hdr.Object_key &&
+		a.hdr.Shard == b.hdr.Shard && a.hdr.Grid == b.hdr.Grid && a.hdr.Region == b.hdr.Region &&
+		a.hdr.Local_position == b.hdr.Local_position &&
+		a.hdr.Local_velocity == b.hdr.Local_velocity && a.hdr.Local_rotation == b.hdr.Local_rotation
+}
+
+//
+//  resolveduplicate -- event is already stored. Is this a resend, or a conflict?
+//
+//  An identical resend is harmless, and gets errDuplicateEvent. A different
+//  event under the same serial number gets logged and errConflictEvent.
+//
+func resolveduplicate(store vehstore, hdr slheader, ev vehlogevent) error {
+	stored, err := store.loadevent(ev.Tripid, ev.Serial)
 	if err != nil {
 		return err
 	}
-	ev, err := Parsevehevent(bodycontent) // parse JSON from vehicle script
-	if err != nil {
-		return err
+	if sameevent(stored, tripevent{hdr: hdr, ev: ev}) {
+		return errDuplicateEvent
 	}
-	return (dbupdate(db, hdr, ev)) // insert in database
+	msg := fmt.Sprintf("Conflicting event for serial %d. Stored: %s %s. Received: %s %s",
+		ev.Serial, stored.ev, stored.hdr, ev, hdr)
+	recorderror(store, ownersource(hdr.Owner_key), errorlogentry{owner_name: hdr.Owner_name, tripid: ev.Tripid, category: statusconflict, msg: msg})
+	return errConflictEvent
 }
 
 //  Handlerequest -- handle a request from a client
 func Handlerequest(sv FastCGIServer, w http.ResponseWriter, bodycontent []byte, req *http.Request) {
-	err := Addevent(bodycontent, req.Header, sv.config, sv.db)
-	if err == nil {
-	    err = dosummarize(sv.db, false)             // do summarization
+	var reply ingestresponse
+	reply.Received = servernow().Unix()
+	var match authmatch
+	var err error
+	if isbatch(bodycontent) {
+		reply.Results, match, err = Addevents(bodycontent, req.Header, sv.config, sv.store)
+		reply.Msg = fmt.Sprintf("Batch of %d events processed", len(reply.Results))
+	} else {
+		var ev vehlogevent
+		_ = json.Unmarshal(bodycontent, &ev) // for serial and trip ID, if we can get them
+		reply.Serial = ev.Serial
+		reply.Tripid = ev.Tripid
+		match, err = Addevent(bodycontent, req.Header, sv.config, sv.store)
+		reply.Msg = "Event logged"
 	}
-	if err != nil {
-		w.WriteHeader(500)           // internal server error
-		w.Write([]byte(err.Error())) // report error as text ***TEMP***
-		w.Write([]byte("\n"))
-		////dumprequest(sv, w, req, bodycontent) // dump entire request as text ***TEMP***
+	reply.Status = ingeststatus(err)
+	if reply.Status != statusbadauth { // signature good, so which version signed it is known
+		reply.Keyversion = match.version
 	}
+	if err != nil { // summarization is done by the summaryworker, not here
+		reply.Msg = err.Error()
+		if reply.Status != statusduplicate && reply.Status != statusconflict { // conflicts were logged with details
+			recorderror(sv.store, requestsource(req, err), errorlogentry{owner_name: requestowner(req, err),
+				tripid: reply.Tripid, category: reply.Status, msg: reply.Msg})
+		}
+	}
+	writereply(w, ingesthttpstatus(err), reply)
+}
+
+//
+//  writereply -- send JSON reply with HTTP status
+//
+func writereply(w http.ResponseWriter, httpstatus int, reply ingestresponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpstatus)
+	json.NewEncoder(w).Encode(reply)
 }
@@ -0,0 +1,134 @@
+//
+//  falls -- sudden altitude changes
+//
+//  A vehicle which falls through a road or off a bridge, often at a region
+//  crossing, shows up as a big drop in Z between two events. A big rise is
+//  a position glitch, such as the simulator putting the vehicle on top of
+//  something after a crossing. Either one makes the trip a fault.
+//
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+//
+//  Constants
+//
+const fallmeters = 10.0      // altitude change this big, or more,
+const fallmeterspersec = 5.0 // at this vertical speed, or more, is a fall or jump
+const defaultfalls = 50      // incidents in report
+
+//
+//  fall -- one sudden altitude change, a row of the falls table
+//
+type fall struct {
+	tripid        string      // ID of trip
+	seq           int32       // 0 for the first incident of the trip, then in order
+	grid          string      // grid name
+	region_name   string      // region where it ended
+	serial        int32       // serial number of event after the change
+	stamp         int64       // time of that event, UNIX, client time
+	kind          string      // ENUM("DROP","JUMP")
+	from_z        float64     // altitude at previous event
+	to_z          float64     // altitude after
+	pos           slglobalpos // position after, global
+	near_crossing bool        // region changed between the events, or one was a crossing event
+}
+
+func (f fall) String() string {
+	verb := "Fell"
+	if f.kind == "JUMP" {
+		verb = "Jumped"
+	}
+	where := "in " + f.region_name
+	if f.near_crossing {
+		where = "crossing into " + f.region_name
+	}
+	return fmt.Sprintf("%s %1.0fm %s", verb, math.Abs(f.to_z-f.from_z), where)
+}
+
+//
+//  iscrossingevent -- true for the events logged at region crossings
+//
+func iscrossingevent(eventtype string) bool {
+	return eventtype == "CROSSSPEED" || eventtype == "CROSSEND"
+}
+
+//
+//  updatefalls -- check for a fall or jump since the previous event
+//
+//  Called before updatecrossings, so r.region is still the previous event's.
+//  Events with unknown altitude are skipped. Events in the same second
+//  count as a second apart.
+//
+func (r *trip) updatefalls(event vehlogevent, hdr slheader, gpos slglobalpos) {
+	defer func() {
+		r.prevtime, r.prevtype = event.Timestamp, event.Eventtype
+	}()
+	if r.region.Name == "" || !r.prevpos.knownz() || !gpos.knownz() { // no previous event, or no altitudes
+		return
+	}
+	dz := gpos.Z - r.prevpos.Z
+	secs := math.Max(float64(event.Timestamp-r.prevtime), 1)
+	if math.Abs(dz) < fallmeters || math.Abs(dz)/secs < fallmeterspersec {
+		return
+	}
+	f := fall{tripid: event.Tripid, seq: int32(len(r.sx.falls)), grid: hdr.Grid, region_name: hdr.Region.Name,
+		serial: event.Serial, stamp: event.Timestamp, kind: "DROP", from_z: r.prevpos.Z, to_z: gpos.Z, pos: gpos,
+		near_crossing: hdr.Region != r.region || iscrossingevent(event.Eventtype) || iscrossingevent(r.prevtype)}
+	if dz > 0 {
+		f.kind = "JUMP"
+	}
+	r.sx.falls = append(r.sx.falls, f)
+	r.addfault(f.String())
+}
+
+//
+//  printfalls -- report of fall incidents, newest first
+//
+func printfalls(out io.Writer, falls []fall) {
+	if len(falls) == 0 {
+		fmt.Fprintf(out, "No falls.\n")
+		return
+	}
+	fmt.Fprintf(out, "%-20s %-24s %-40s %6s %5s %8s %8s %s\n",
+		"Grid", "Region", "Trip", "Serial", "Kind", "From Z", "To Z", "Crossing")
+	for _, f := range falls {
+		fmt.Fprintf(out, "%-20s %-24s %-40s %6d %5s %8.1f %8.1f %v\n",
+			f.grid, f.region_name, f.tripid, f.serial, f.kind, f.from_z, f.to_z, f.near_crossing)
+	}
+}
+
+//
+//  fallscommand -- "vehiclelogserver falls [flags]"
+//
+func fallscommand(args []string) error {
+	flags := flag.NewFlagSet("falls", flag.ContinueOnError)
+	cfile := flags.String("config", configloc, "configuration file")
+	grid := flags.String("grid", "", "falls on this grid; all grids if not given")
+	region := flags.String("region", "", "falls in this region")
+	limit := flags.Int("limit", defaultfalls, "report this many falls, newest first; 0 for all")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *limit < 0 {
+		return errors.New("-limit must not be negative")
+	}
+	sv := new(FastCGIServer)
+	if err := initdb(*cfile, sv); err != nil {
+		return err
+	}
+	defer sv.store.close()
+	falls, err := sv.store.findfalls(*grid, *region, *limit)
+	if err != nil {
+		return err
+	}
+	printfalls(os.Stdout, falls)
+	return nil
+}
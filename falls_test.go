@@ -0,0 +1,109 @@
+//
+//  Tests for fall detection
+//
+package main
+
+import (
+	"testing"
+)
+
+//
+//  fallstep -- an event for a fall test
+//
+type fallstep struct {
+	eventtype string
+	region    slregion
+	secs      int64   // since start
+	z         float32 // local Z; -1 for unknown
+}
+
+var fallregiona = slregion{Name: "Vallone", X: 462592, Y: 306944}
+var fallregionb = slregion{Name: "Jeogeot", X: 462848, Y: 306944}
+
+var fallsteps = []fallstep{
+	{"STARTUP", fallregiona, 0, -1}, // altitude unknown
+	{"SLOW", fallregiona, 10, 30},
+	{"CROSSSPEED", fallregionb, 11, 5}, // fell through the road at the crossing
+	{"TICK", fallregionb, 21, 20},      // climbed out, slowly
+	{"TICK", fallregionb, 22, 45},      // glitch
+	{"TICK", fallregionb, 23, -1},
+	{"SHUTDOWN", fallregionb, 30, 45},
+}
+
+//
+//  fallevents -- the events of fallsteps
+//
+func fallevents(tripid string) []tripevent {
+	var events []tripevent
+	for i, step := range fallsteps {
+		hdr, ev := testevent(tripid, int32(i))
+		hdr.Region = step.region
+		hdr.Local_position = slvector{X: 128, Y: 128, Z: step.z}
+		ev.Eventtype = step.eventtype
+		ev.Timestamp += step.secs
+		events = append(events, tripevent{hdr: hdr, ev: ev})
+	}
+	return events
+}
+
+func TestFalls(t *testing.T) {
+	var tr trip
+	for i, te := range fallevents("x") {
+		tr.updatefromevent(te.ev, te.hdr, i == 0)
+	}
+	falls := tr.sx.falls
+	if len(falls) != 2 {
+		t.Fatalf("Got %d falls, expected 2: %v", len(falls), falls)
+	}
+	if f := falls[0]; f.kind != "DROP" || !f.near_crossing || f.serial != 2 || f.from_z != 30 || f.to_z != 5 || f.region_name != "Jeogeot" {
+		t.Errorf("First fall: %v", f)
+	}
+	if f := falls[1]; f.kind != "JUMP" || f.near_crossing || f.serial != 4 || f.seq != 1 {
+		t.Errorf("Second fall: %v", f)
+	}
+	if tr.sx.trip_status != "FAULT" || tr.sx.msg != "Fell 25m crossing into Jeogeot; Jumped 25m in Jeogeot" {
+		t.Errorf("Trip status %s, msg \"%s\"", tr.sx.trip_status, tr.sx.msg)
+	}
+	if tr.sx.min_pos.Z != 5 || tr.sx.max_pos.Z != 45 {
+		t.Errorf("Altitude %f to %f, expected 5 to 45", tr.sx.min_pos.Z, tr.sx.max_pos.Z)
+	}
+}
+
+//
+//  checkfalls -- falls are stored with the trip and found by region
+//
+func checkfalls(t *testing.T, store vehstore) {
+	tripid := GenerateRandomTripid()
+	if _, err := store.appendevents(fallevents(tripid), usednonce{}); err != nil {
+		t.Fatal(err)
+	}
+	agetodo(t, store)
+	if n, err := dosummarize(store, "test", false); n != 1 || err != nil {
+		t.Fatalf("Summarized %d trips, err %v, expected 1", n, err)
+	}
+	r, err := store.loadtripsummary(tripid)
+	if err != nil || r.trip_status != "FAULT" || r.min_pos.Z != 5 || r.max_pos.Z != 45 || r.msg == "" {
+		t.Errorf("Trip status %s, altitude %f to %f, msg \"%s\", err %v", r.trip_status, r.min_pos.Z, r.max_pos.Z, r.msg, err)
+	}
+	if falls, err := store.tripfalls(tripid); err != nil || len(falls) != 2 || falls[0].kind != "DROP" || !falls[0].near_crossing {
+		t.Errorf("Trip falls: %v, err %v", falls, err)
+	}
+	segments, _ := store.tripsegments(tripid)
+	if len(segments) != 2 || segments[0].entry_pos.Z != -1 || segments[1].exit_pos.Z != 45 {
+		t.Errorf("Segments: %v", segments)
+	}
+	falls, err := store.findfalls("Production", "Jeogeot", 0)
+	if err != nil || len(falls) != 2 || falls[0].serial != 4 { // newest first
+		t.Errorf("Falls in region: %v, err %v", falls, err)
+	}
+	if falls, _ := store.findfalls("", "", 1); len(falls) != 1 {
+		t.Errorf("Limited falls: got %d, expected 1", len(falls))
+	}
+	if falls, _ := store.findfalls("Production", "Vallone", 0); len(falls) != 0 {
+		t.Errorf("Falls in region with none: %v", falls)
+	}
+}
+
+func TestFallsStored(t *testing.T) {
+	forstores(t, checkfalls)
+}
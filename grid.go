@@ -0,0 +1,172 @@
+//
+//  grid -- which grid an event came from
+//
+//  Second Life sends X-Secondlife-Shard, "Production" for the main grid.
+//  OpenSimulator grids usually send the generic shard "OpenSim", or none,
+//  so region names from different grids would collide. The grid is taken
+//  from the config file's mapping if there is one, then the shard, then
+//  the domain of the simulator host in the Via header.
+//
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+//
+//  Constants
+//
+const genericshard = "OpenSim" // OpenSimulator's default shard name, says nothing about the grid
+
+//
+//  regionstat -- activity in one region of one grid
+//
+type regionstat struct {
+	grid        string // grid name
+	region_name string // region name, unique within grid
+	events      int    // events logged in region
+	trips       int    // trips which logged events in region
+	faults      int    // trouble events in region
+}
+
+//
+//  regionkey -- a region, which is only unique within its grid
+//
+type regionkey struct {
+	grid        string
+	region_name string
+}
+
+//
+//  tripfilter -- selects trips. Empty fields match everything.
+//
+type tripfilter struct {
+	grid        string    // trips on this grid
+	region_name string    // trips which logged events in this region
+	owner_name  string    // trips by this owner
+	owner_key   string    // trips by this owner, by key
+	object_name string    // trips by this object
+	object_key  string    // trips by this object, by key, across renames
+	since       time.Time // trips ending at or after this
+	until       time.Time // trips ending before this
+	trip_status string    // trips which ended this way
+	limit       int       // at most this many, newest first; 0 for no limit
+}
+
+//
+//  matchsummary -- true if trip summary passes filter, other than the region test
+//
+func (f tripfilter) matchsummary(r tripsummary) bool {
+	return (f.grid == "" || r.grid == f.grid) &&
+		(f.owner_name == "" || r.owner_name == f.owner_name) &&
+		(f.owner_key == "" || r.owner_key == f.owner_key) &&
+		(f.object_name == "" || r.object_name == f.object_name) &&
+		(f.object_key == "" || r.object_key == f.object_key) &&
+		(f.since.IsZero() || !r.stamp.Before(f.since)) &&
+		(f.until.IsZero() || r.stamp.Before(f.until)) &&
+		(f.trip_status == "" || r.trip_status == f.trip_status)
+}
+
+//
+//  viahost -- simulator host name from a Via header
+//
+//  "1.1 sim10317.agni.lindenlab.com:3128 (squid/2.7.STABLE9)" gives
+//  "sim10317.agni.lindenlab.com". Only the first entry is used; later
+//  ones were added by proxies on our side.
+//
+func viahost(via string) string {
+	entry := strings.SplitN(via, ",", 2)[0]
+	fields := strings.Fields(entry)
+	if len(fields) < 2 {
+		return ""
+	}
+	host := fields[1]
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.Trim(host, "[]"))
+}
+
+//
+//  parentdomain -- "sim1.agni.lindenlab.com" -> "agni.lindenlab.com". Empty at top.
+//
+func parentdomain(host string) string {
+	ix := strings.Index(host, ".")
+	if ix < 0 || net.ParseIP(host) != nil {
+		return ""
+	}
+	return host[ix+1:]
+}
+
+//
+//  Parsegrid -- grid name for a request
+//
+func Parsegrid(headervars http.Header, shard string, config vdbconfig) (string, error) {
+	host := viahost(headervars.Get("Via"))
+	if grid, ok := config.Grids[shard]; ok && shard != "" { // configured by shard
+		return grid, nil
+	}
+	for d := host; d != ""; d = parentdomain(d) { // configured by host or domain
+		if grid, ok := config.Grids[d]; ok {
+			return grid, nil
+		}
+	}
+	if shard != "" && shard != genericshard {
+		return shard, nil
+	}
+	if host != "" { // the simulators of a grid share a domain
+		if d := parentdomain(host); strings.Contains(d, ".") {
+			return d, nil
+		}
+		return host, nil
+	}
+	if shard != "" {
+		return shard, nil
+	}
+	return "", &headererror{errors.New("Unable to tell which grid request came from. No X-Secondlife-Shard or Via header")}
+}
+
+//
+//  printregionstats -- report of activity by region
+//
+func printregionstats(out io.Writer, stats []regionstat) {
+	if len(stats) == 0 {
+		fmt.Fprintf(out, "No regions.\n")
+		return
+	}
+	fmt.Fprintf(out, "%-20s %-24s %8s %6s %6s\n", "Grid", "Region", "Events", "Trips", "Faults")
+	for _, st := range stats {
+		fmt.Fprintf(out, "%-20s %-24s %8d %6d %6d\n", st.grid, st.region_name, st.events, st.trips, st.faults)
+	}
+}
+
+//
+//  regionscommand -- "vehiclelogserver regions [flags]"
+//
+func regionscommand(args []string) error {
+	flags := flag.NewFlagSet("regions", flag.ContinueOnError)
+	cfile := flags.String("config", configloc, "configuration file")
+	grid := flags.String("grid", "", "regions on this grid; all grids if not given")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	sv := new(FastCGIServer)
+	if err := initdb(*cfile, sv); err != nil {
+		return err
+	}
+	defer sv.store.close()
+	stats, err := sv.store.regionstats(*grid)
+	if err != nil {
+		return err
+	}
+	printregionstats(os.Stdout, stats)
+	return nil
+}
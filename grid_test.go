@@ -0,0 +1,114 @@
+//
+//  Tests for grid identification
+//
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestParsegrid(t *testing.T) {
+	config := testcfg
+	config.Grids = map[string]string{"Testing": "Second Life Beta", "hg.example.net": "Example Grid"}
+	tests := []struct {
+		shard string
+		via   string
+		grid  string // "" if error expected
+	}{
+		{"Production", "1.1 sim10317.agni.lindenlab.com:3128 (squid/2.7.STABLE9)", "Production"},
+		{"Testing", "1.1 sim8.aditi.lindenlab.com:3128 (squid/2.7.STABLE9)", "Second Life Beta"}, // configured by shard
+		{"OpenSim", "1.1 sim3.hg.example.net:9000", "Example Grid"},                              // configured by domain
+		{"OpenSim", "1.1 region7.osgrid.org:9000, 1.1 proxy.ourserver.com", "osgrid.org"},
+		{"", "1.1 10.1.2.3:9000", "10.1.2.3"},
+		{"OpenSim", "", "OpenSim"},
+		{"", "", ""},
+	}
+	for _, test := range tests {
+		hdr := http.Header{}
+		if test.via != "" {
+			hdr.Set("Via", test.via)
+		}
+		grid, err := Parsegrid(hdr, test.shard, config)
+		if test.grid == "" {
+			if _, ok := err.(*headererror); !ok {
+				t.Errorf("Shard \"%s\", Via \"%s\": expected header error, got \"%s\", %v", test.shard, test.via, grid, err)
+			}
+			continue
+		}
+		if err != nil || grid != test.grid {
+			t.Errorf("Shard \"%s\", Via \"%s\": got \"%s\", %v, expected \"%s\"", test.shard, test.via, grid, err, test.grid)
+		}
+	}
+}
+
+//
+//  checkgridpartition -- same region name on two grids doesn't collide
+//
+func checkgridpartition(t *testing.T, sv *FastCGIServer) {
+	tripids := []string{GenerateRandomTripid(), GenerateRandomTripid()}
+	for i, via := range []string{"1.1 sim10317.agni.lindenlab.com:3128", "1.1 region7.osgrid.org:9000"} {
+		testjson := []byte(fmt.Sprintf(`{"timestamp":1521264571,"tripid":"%s","severity":1,"eventtype":"STARTUP","msg":"John Doe/Joe"}`, tripids[i]))
+		hdr := signedheader(testjson)
+		hdr.Set("X-Secondlife-Shard", "OpenSim")
+		hdr.Set("Via", via)
+		hdr.Set("X-Secondlife-Region", "Neumoegen (100, 200)")
+		if _, reply := postevent(t, sv, testjson, hdr); reply.Status != statusok {
+			t.Fatalf("Event %d: %+v", i, reply)
+		}
+	}
+	agetodo(t, sv.store)
+	if n, err := dosummarize(sv.store, "test", false); n != 2 || err != nil {
+		t.Fatalf("Summarized %d trips, err %v, expected 2", n, err)
+	}
+	stats, err := sv.store.regionstats("osgrid.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].region_name != "Neumoegen" || stats[0].trips != 1 || stats[0].events != 1 {
+		t.Errorf("Region stats for grid: %+v", stats)
+	}
+	stats, _ = sv.store.regionstats("")
+	if len(stats) != 2 || stats[0].grid != "agni.lindenlab.com" || stats[1].grid != "osgrid.org" {
+		t.Errorf("Region stats for all grids: %+v", stats)
+	}
+	trips, err := sv.store.findtrips(tripfilter{grid: "osgrid.org", region_name: "Neumoegen"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trips) != 1 || trips[0].tripid != tripids[1] || trips[0].grid != "osgrid.org" {
+		t.Errorf("Trips in region on grid: %+v", trips)
+	}
+	trips, _ = sv.store.findtrips(tripfilter{region_name: "Neumoegen", owner_name: "animats Resident", limit: 5})
+	if len(trips) != 2 {
+		t.Errorf("Got %d trips in region on all grids, expected 2", len(trips))
+	}
+}
+
+func TestGridPartition(t *testing.T) {
+	forservers(t, checkgridpartition)
+}
+
+//
+//  checkregionfaults -- faults in region stats are what istrouble says, whatever the store
+//
+func checkregionfaults(t *testing.T, store vehstore) {
+	tripid := GenerateRandomTripid()
+	for i, eventtype := range []string{"STARTUP", "SCRIPTFAIL", "DBERR", "Failed", "error", "SHUTDOWN"} {
+		hdr, ev := testevent(tripid, int32(i))
+		ev.Eventtype = eventtype
+		mustappend(t, store, hdr, ev)
+	}
+	stats, err := store.regionstats("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].events != 6 || stats[0].faults != 2 {
+		t.Errorf("Region stats: %+v, expected 6 events, 2 faults", stats)
+	}
+}
+
+func TestRegionFaults(t *testing.T) {
+	forstores(t, checkregionfaults)
+}
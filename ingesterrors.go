@@ -0,0 +1,151 @@
+//
+//  ingesterrors -- error types for ingest, and the replies they produce
+//
+//  Each stage of ingest returns its own error type, so the request handler
+//  can tell a script bug from an outage and pick the HTTP status to match.
+//
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"github.com/go-sql-driver/mysql"
+	"github.com/mattn/go-sqlite3"
+	"net"
+	"net/http"
+)
+
+//
+//  autherror -- from Validateauthtoken or Authorizekey
+//
+type autherror struct {
+	forbidden bool  // token name known but signature bad; otherwise token unknown
+	err       error // underlying error
+}
+
+func (e *autherror) Error() string {
+	return e.err.Error()
+}
+
+//
+//  headererror -- from Parseheader; missing or malformed X-Secondlife-* field
+//
+type headererror struct {
+	err error // underlying error
+}
+
+func (e *headererror) Error() string {
+	return e.err.Error()
+}
+
+//
+//  eventerror -- from Parsevehevent; malformed JSON or bad event field
+//
+type eventerror struct {
+	err error // underlying error
+}
+
+func (e *eventerror) Error() string {
+	return e.err.Error()
+}
+
+//
+//  dberror -- from the storage layer
+//
+type dberror struct {
+	unavailable bool  // database down, overloaded, or locked; retry later
+	err         error // underlying error
+}
+
+func (e *dberror) Error() string {
+	return e.err.Error()
+}
+
+//
+//  isunavailable -- true if a database error means "can't reach it right now"
+//
+func isunavailable(err error) bool {
+	if err == driver.ErrBadConn || err == mysql.ErrInvalidConn {
+		return true
+	}
+	var neterr net.Error
+	if errors.As(err, &neterr) { // can't connect
+		return true
+	}
+	switch e := err.(type) {
+	case *mysql.MySQLError:
+		switch e.Number {
+		case 1040, 1053, 1205, 1213: // too many connections, shutdown, lock wait timeout, deadlock
+			return true
+		}
+	case sqlite3.Error:
+		return e.Code == sqlite3.ErrBusy || e.Code == sqlite3.ErrLocked || e.Code == sqlite3.ErrCantOpen
+	}
+	return false
+}
+
+//
+//  dbfail -- wrap a storage error as a dberror, passing nil and the sentinel errors through
+//
+func dbfail(err error) error {
+	switch err {
+	case nil, errDuplicateEvent, errConflictEvent, errReplayedNonce, errNoEvent, errNoTrip, errNoPendingTrip, errLeaseLost:
+		return err
+	}
+	if _, ok := err.(*dberror); ok {
+		return err
+	}
+	return &dberror{unavailable: isunavailable(err), err: err}
+}
+
+//
+//  ingeststatus -- status value to report for an error
+//
+func ingeststatus(err error) string {
+	if err == nil {
+		return statusok
+	}
+	switch err {
+	case errDuplicateEvent:
+		return statusduplicate
+	case errConflictEvent:
+		return statusconflict
+	}
+	switch err.(type) {
+	case *autherror:
+		return statusbadauth
+	case *headererror:
+		return statusbadheader
+	case *eventerror:
+		return statusbadjson
+	case *dberror:
+		return statusdberror
+	}
+	return statusinternal
+}
+
+//
+//  ingesthttpstatus -- HTTP status to report for an error
+//
+func ingesthttpstatus(err error) int {
+	switch err {
+	case nil, errDuplicateEvent: // identical resend is a harmless no-op
+		return http.StatusOK
+	case errConflictEvent:
+		return http.StatusConflict
+	}
+	switch e := err.(type) {
+	case *autherror:
+		if e.forbidden {
+			return http.StatusForbidden
+		}
+		return http.StatusUnauthorized
+	case *headererror, *eventerror:
+		return http.StatusBadRequest
+	case *dberror:
+		if e.unavailable {
+			return http.StatusServiceUnavailable
+		}
+	}
+	return http.StatusInternalServerError // a bug
+}
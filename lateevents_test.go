@@ -0,0 +1,101 @@
+//
+//  Tests for events which arrive after their trip was summarized
+//
+package main
+
+import (
+	"testing"
+)
+
+//
+//  checklateevents -- an event after the trip was summarized makes a new revision
+//
+func checklateevents(t *testing.T, store vehstore) {
+	tripid := GenerateRandomTripid()
+	for _, serial := range []int32{0, 2} { // serial 1 delayed
+		hdr, ev := testevent(tripid, serial)
+		if serial == 2 {
+			ev.Eventtype = "SHUTDOWN"
+		}
+		mustappend(t, store, hdr, ev)
+	}
+	agetodo(t, store)
+	if n, err := dosummarize(store, "test", false); n != 1 || err != nil {
+		t.Fatalf("First summary: %d trips, %v", n, err)
+	}
+	r, _ := store.loadtripsummary(tripid)
+	if r.revision != 1 || r.late_events != 0 || r.data_status != "MISSING" || r.recomputed.IsZero() {
+		t.Errorf("First summary: revision %d, %d late events, data %s, recomputed %s", r.revision, r.late_events, r.data_status, r.recomputed)
+	}
+	//  Straggler arrives
+	hdr, ev := testevent(tripid, 1)
+	ev.Eventtype = "SLOW"
+	mustappend(t, store, hdr, ev)
+	te, err := store.loadevent(tripid, 1)
+	if err != nil || !te.ev.Late {
+		t.Errorf("Event not marked late, err %v", err)
+	}
+	agetodo(t, store)
+	if n, err := dosummarize(store, "test", false); n != 1 || err != nil {
+		t.Fatalf("Second summary: %d trips, %v", n, err)
+	}
+	r, _ = store.loadtripsummary(tripid)
+	if r.revision != 2 || r.late_events != 1 || r.data_status != "OK" {
+		t.Errorf("Second summary: revision %d, %d late events, data %s", r.revision, r.late_events, r.data_status)
+	}
+	//  Event arrives while trip is being summarized
+	tripid = GenerateRandomTripid()
+	hdr, ev = testevent(tripid, 0)
+	mustappend(t, store, hdr, ev)
+	agetodo(t, store)
+	_, stamp, err := store.claimtrip("test", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr, ev = testevent(tripid, 1)
+	mustappend(t, store, hdr, ev)
+	if err := store.writetripsummary("test", tripsummary{tripid: tripid, stamp: stamp, trip_status: "OK", data_status: "OK"}); err != nil {
+		t.Fatal(err)
+	}
+	agetodo(t, store)
+	if id, _, err := store.pendingtrip(); id != tripid || err != nil {
+		t.Errorf("Trip with new event taken off to-do list: \"%s\", %v", id, err)
+	}
+}
+
+func TestLateEvents(t *testing.T) {
+	forstores(t, checklateevents)
+}
+
+//
+//  checkfaultcontinues -- a trip summarized after a fault hasn't ended, so its next event isn't late
+//
+func checkfaultcontinues(t *testing.T, store vehstore) {
+	tripid := GenerateRandomTripid()
+	for i, eventtype := range []string{"STARTUP", "SCRIPTFAIL"} {
+		hdr, ev := testevent(tripid, int32(i))
+		ev.Eventtype = eventtype
+		mustappend(t, store, hdr, ev)
+	}
+	agetodo(t, store)
+	dosummarize(store, "test", false)
+	if r, _ := store.loadtripsummary(tripid); r.trip_status != "FAULT" || r.ended_shutdown {
+		t.Fatalf("Faulted trip: status %s, ended with SHUTDOWN %t, expected FAULT, not ended", r.trip_status, r.ended_shutdown)
+	}
+	hdr, ev := testevent(tripid, 2) // script recovered, trip goes on
+	ev.Eventtype = "SHUTDOWN"
+	mustappend(t, store, hdr, ev)
+	if te, _ := store.loadevent(tripid, 2); te.ev.Late {
+		t.Errorf("Event continuing faulted trip marked late")
+	}
+	agetodo(t, store)
+	dosummarize(store, "test", false)
+	r, _ := store.loadtripsummary(tripid)
+	if r.trip_status != "FAULT" || !r.ended_shutdown || r.revision != 2 || r.late_events != 0 {
+		t.Errorf("Continued faulted trip: status %s, ended with SHUTDOWN %t, revision %d, %d late events", r.trip_status, r.ended_shutdown, r.revision, r.late_events)
+	}
+}
+
+func TestFaultContinues(t *testing.T) {
+	forstores(t, checkfaultcontinues)
+}
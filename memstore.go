@@ -0,0 +1,441 @@
+//
+//  memstore -- vehstore kept in memory
+//
+//  For tests and for small deployments which don't need to keep
+//  data across restarts.
+//
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+//
+//  memstore -- events, to-do list, and trips, like the SQL tables
+//
+type memstore struct {
+	mu     sync.Mutex
+	events map[string][]tripevent   // events by trip ID
+	todo   map[string]memtodo       // trips in progress, by trip ID
+	leases map[string]memlease      // trip ID -> summarizer working on it
+	trips  map[string]tripsummary   // summarized trips by trip ID
+	segs   map[string][]tripsegment // segments of summarized trips by trip ID
+	cross  map[string][]crossing    // crossings of summarized trips by trip ID
+	falls  map[string][]fall        // falls in summarized trips by trip ID
+	errlog []errorlogentry          // error log, oldest first
+	nonces map[string]time.Time     // signed time of used nonces, by key name and nonce
+	now    func() time.Time         // clock, replaceable for testing
+}
+
+//
+//  memtodo -- to-do entry, like a row of tripstodo
+//
+type memtodo struct {
+	stamp    time.Time // last event
+	created  time.Time // trip start, or last summary of a running trip
+	idlesecs int       // trip over after this long without events
+	maxsecs  int       // summarize running trip after this long; 0 for no limit
+}
+
+//
+//  memlease -- claim on a to-do entry
+//
+type memlease struct {
+	owner   string    // worker
+	expires time.Time // when others may take it
+}
+
+func newmemstore() *memstore {
+	return &memstore{
+		events: make(map[string][]tripevent),
+		todo:   make(map[string]memtodo),
+		leases: make(map[string]memlease),
+		trips:  make(map[string]tripsummary),
+		segs:   make(map[string][]tripsegment),
+		cross:  make(map[string][]crossing),
+		falls:  make(map[string][]fall),
+		nonces: make(map[string]time.Time),
+		now:    time.Now,
+	}
+}
+
+func (s *memstore) close() error {
+	return nil
+}
+
+//
+//  insertevent -- add one event. Caller holds lock.
+//
+func (s *memstore) insertevent(hdr slheader, ev vehlogevent) error {
+	for _, te := range s.events[ev.Tripid] { // enforce UNIQUE(tripid, serial)
+		if te.ev.Serial == ev.Serial {
+			return errDuplicateEvent
+		}
+	}
+	r, summarized := s.trips[ev.Tripid]
+	ev.Late = summarized && r.ended_shutdown // trip had ended; otherwise it reopens
+	s.events[ev.Tripid] = append(s.events[ev.Tripid], tripevent{hdr: hdr, ev: ev})
+	s.touchtodo(ev.Tripid, hdr.Object_name)
+	return nil
+}
+
+//
+//  touchtodo -- add or refresh to-do entry. Caller holds lock.
+//
+func (s *memstore) touchtodo(tripid string, object_name string) {
+	now := s.now()
+	td, ok := s.todo[tripid]
+	if !ok { // new trip, or reopened one
+		td.created = now
+		td.idlesecs, td.maxsecs = tripend.forobject(object_name)
+	}
+	td.stamp = now
+	s.todo[tripid] = td
+}
+
+//
+//  usenonce -- errReplayedNonce if nonce was used before. Caller holds lock.
+//
+func (s *memstore) usenonce(n usednonce, record bool) error {
+	if n.nonce == "" { // legacy message
+		return nil
+	}
+	k := n.key_name + "\n" + n.nonce // enforce UNIQUE(key_name, nonce)
+	if _, ok := s.nonces[k]; ok {
+		return errReplayedNonce
+	}
+	if record {
+		s.nonces[k] = n.stamp
+	}
+	return nil
+}
+
+func (s *memstore) appendevent(hdr slheader, ev vehlogevent, n usednonce) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.usenonce(n, false); err != nil {
+		return err
+	}
+	err := s.insertevent(hdr, ev)
+	if err == nil { // a duplicate event undoes the nonce, as the SQL transaction does
+		s.usenonce(n, true)
+	}
+	return err
+}
+
+func (s *memstore) appendevents(events []tripevent, n usednonce) ([]error, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.usenonce(n, true); err != nil {
+		return nil, err
+	}
+	results := make([]error, len(events))
+	for i, te := range events {
+		results[i] = s.insertevent(te.hdr, te.ev)
+	}
+	return results, nil
+}
+
+func (s *memstore) prunenonces(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, stamp := range s.nonces {
+		if stamp.Before(before) {
+			delete(s.nonces, k)
+		}
+	}
+	return nil
+}
+
+func (s *memstore) marktrippending(tripid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.touchtodo(tripid, "")
+	return nil
+}
+
+func (s *memstore) pendingtrip() (string, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.oldesttodo()
+}
+
+//
+//  oldesttodo -- oldest unleased to-do entry for a trip which is over. Caller holds lock.
+//
+func (s *memstore) oldesttodo() (string, time.Time, error) {
+	var tripid string
+	var stamp time.Time
+	now := s.now()
+	for id, td := range s.todo { // oldest eligible entry
+		idle := now.Sub(td.stamp) > time.Duration(td.idlesecs)*time.Second
+		long := td.maxsecs > 0 && now.Sub(td.created) > time.Duration(td.maxsecs)*time.Second
+		if !idle && !long {
+			continue
+		}
+		if l, ok := s.leases[id]; ok && now.Before(l.expires) { // another worker has it
+			continue
+		}
+		if tripid == "" || td.stamp.Before(stamp) {
+			tripid = id
+			stamp = td.stamp
+		}
+	}
+	if tripid == "" {
+		return tripid, stamp, errNoPendingTrip
+	}
+	return tripid, stamp, nil
+}
+
+func (s *memstore) claimtrip(worker string, leasesecs int) (string, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tripid, stamp, err := s.oldesttodo()
+	if err == nil {
+		s.leases[tripid] = memlease{owner: worker, expires: s.now().Add(time.Duration(leasesecs) * time.Second)}
+	}
+	return tripid, stamp, err
+}
+
+func (s *memstore) tripevents(tripid string) ([]tripevent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := append([]tripevent(nil), s.events[tripid]...)
+	sort.Slice(events, func(i, j int) bool { return events[i].ev.Serial < events[j].ev.Serial })
+	return events, nil
+}
+
+func (s *memstore) loadevent(tripid string, serial int32) (tripevent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, te := range s.events[tripid] {
+		if te.ev.Serial == serial {
+			return te, nil
+		}
+	}
+	return tripevent{}, errNoEvent
+}
+
+func (s *memstore) logerror(e errorlogentry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.stamp = s.now()
+	s.errlog = append(s.errlog, e)
+	return nil
+}
+
+func (s *memstore) recenterrors(owner_name string, tripid string, limit int) ([]errorlogentry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []errorlogentry
+	for i := len(s.errlog) - 1; i >= 0 && len(entries) < limit; i-- { // newest first
+		e := s.errlog[i]
+		if (owner_name == "" || e.owner_name == owner_name) && (tripid == "" || e.tripid == tripid) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func (s *memstore) writetripsummary(worker string, r tripsummary) error {
+	if r.tripid == "" {
+		return errors.New("writetripsummary: empty tripid")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l, ok := s.leases[r.tripid]; !ok || l.owner != worker || !s.now().Before(l.expires) { // not ours any more
+		return errLeaseLost
+	}
+	s.storetrip(r)
+	s.deletetodo(worker, r.tripid, r.stamp)
+	return nil
+}
+
+func (s *memstore) rebuildtripsummary(r tripsummary) error {
+	if r.tripid == "" {
+		return errors.New("rebuildtripsummary: empty tripid")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.storetrip(r) // to-do list and leases untouched
+	return nil
+}
+
+//
+//  storetrip -- store trip, segments, crossings, and falls. Caller holds lock.
+//
+func (s *memstore) storetrip(r tripsummary) {
+	r.revision = s.trips[r.tripid].revision + 1 // duplicate tripid - replace, as a new revision
+	r.recomputed = s.now()
+	s.segs[r.tripid] = append([]tripsegment(nil), r.segments...)
+	s.cross[r.tripid] = append([]crossing(nil), r.crossings...)
+	s.falls[r.tripid] = append([]fall(nil), r.falls...)
+	r.segments, r.crossings, r.falls = nil, nil, nil // kept separately, like the SQL tables
+	s.trips[r.tripid] = r
+}
+
+func (s *memstore) droptodo(worker string, tripid string, stamp time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deletetodo(worker, tripid, stamp)
+	return nil
+}
+
+//
+//  deletetodo -- end worker's lease, and delete to-do entry unless an event arrived after stamp. Caller holds lock.
+//
+func (s *memstore) deletetodo(worker string, tripid string, stamp time.Time) {
+	if l, ok := s.leases[tripid]; !ok || l.owner != worker { // another worker's, or none
+		return
+	}
+	delete(s.leases, tripid)
+	if td, ok := s.todo[tripid]; ok && td.stamp.After(stamp) { // event arrived while summarizing
+		td.created = s.now() // summarize again, when over or after another maximum trip time
+		s.todo[tripid] = td
+		return
+	}
+	delete(s.todo, tripid)
+}
+
+func (s *memstore) loadtripsummary(tripid string) (tripsummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.trips[tripid]
+	if !ok {
+		return r, errNoTrip
+	}
+	return r, nil
+}
+
+func (s *memstore) tripsegments(tripid string) ([]tripsegment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]tripsegment(nil), s.segs[tripid]...), nil
+}
+
+func (s *memstore) tripcrossings(tripid string) ([]crossing, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]crossing(nil), s.cross[tripid]...), nil
+}
+
+func (s *memstore) tripfalls(tripid string) ([]fall, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fall(nil), s.falls[tripid]...), nil
+}
+
+func (s *memstore) findfalls(grid string, region_name string, limit int) ([]fall, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var falls []fall
+	for _, fs := range s.falls {
+		for _, f := range fs {
+			if (grid == "" || f.grid == grid) && (region_name == "" || f.region_name == region_name) {
+				falls = append(falls, f)
+			}
+		}
+	}
+	sort.Slice(falls, func(i, j int) bool {
+		a, b := falls[i], falls[j]
+		if a.stamp != b.stamp {
+			return a.stamp > b.stamp
+		}
+		if a.tripid != b.tripid {
+			return a.tripid < b.tripid
+		}
+		return a.seq < b.seq
+	})
+	if limit > 0 && len(falls) > limit {
+		falls = falls[:limit]
+	}
+	return falls, nil
+}
+
+func (s *memstore) findtrips(f tripfilter) ([]tripsummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var trips []tripsummary
+	for tripid, r := range s.trips {
+		if !f.matchsummary(r) {
+			continue
+		}
+		if f.region_name != "" && !s.visited(tripid, f.grid, f.region_name) {
+			continue
+		}
+		trips = append(trips, r)
+	}
+	sort.Slice(trips, func(i, j int) bool { return trips[i].stamp.After(trips[j].stamp) })
+	if f.limit > 0 && len(trips) > f.limit {
+		trips = trips[:f.limit]
+	}
+	return trips, nil
+}
+
+//
+//  visited -- true if trip logged an event in region. Caller holds lock.
+//
+func (s *memstore) visited(tripid string, grid string, region_name string) bool {
+	for _, te := range s.events[tripid] {
+		if te.hdr.Region.Name == region_name && (grid == "" || te.hdr.Grid == grid) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memstore) regionstats(grid string) ([]regionstat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bykey := make(map[regionkey]*regionstat)
+	for _, events := range s.events {
+		seen := make(map[regionkey]bool) // regions this trip was in
+		for _, te := range events {
+			if grid != "" && te.hdr.Grid != grid {
+				continue
+			}
+			k := regionkey{te.hdr.Grid, te.hdr.Region.Name}
+			st := bykey[k]
+			if st == nil {
+				st = &regionstat{grid: k.grid, region_name: k.region_name}
+				bykey[k] = st
+			}
+			st.events++
+			if istrouble(te.ev.Eventtype) {
+				st.faults++
+			}
+			if !seen[k] {
+				seen[k] = true
+				st.trips++
+			}
+		}
+	}
+	var stats []regionstat
+	for _, st := range bykey {
+		stats = append(stats, *st)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].grid != stats[j].grid {
+			return stats[i].grid < stats[j].grid
+		}
+		return stats[i].region_name < stats[j].region_name
+	})
+	return stats, nil
+}
+
+func (s *memstore) boundarystats(grid string, mincrossings int, limit int) ([]boundarystat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var crossings []crossing
+	for _, cs := range s.cross {
+		for _, c := range cs {
+			if grid == "" || c.grid == grid {
+				crossings = append(crossings, c)
+			}
+		}
+	}
+	return boundarytotals(crossings, mincrossings, limit), nil
+}
@@ -0,0 +1,105 @@
+//
+//  motion -- speed and attitude, from the velocity and rotation headers
+//
+//  Second Life sends the vehicle's velocity and rotation with every request.
+//  The summarizer uses them for trip speed statistics, total turning, and
+//  to catch a vehicle which flipped over, or spun out and went sideways
+//  or backwards at speed. Flips and spins make the trip a fault.
+//
+package main
+
+import (
+	"math"
+)
+
+//
+//  Constants
+//
+const spinminspeed = 5.0 // a spin is going this fast, meters/sec, or more,
+const spindegrees = 90.0 // with this angle, or more, between heading and direction of travel
+
+//
+//  known -- true if rotation was sent. A real rotation is never all zero.
+//
+func (q slquaternion) known() bool {
+	return q.X != 0 || q.Y != 0 || q.Z != 0 || q.S != 0
+}
+
+//
+//  forward -- unit vector along the object's X axis, the way it faces, as llRot2Fwd
+//
+func (q slquaternion) forward() (float64, float64, float64) {
+	x, y, z, s := float64(q.X), float64(q.Y), float64(q.Z), float64(q.S)
+	n := x*x + y*y + z*z + s*s // 1 unless rounded
+	return (s*s + x*x - y*y - z*z) / n, 2 * (x*y + s*z) / n, 2 * (x*z - s*y) / n
+}
+
+//
+//  upz -- Z of the unit vector along the object's Z axis, as llRot2Up. Negative if upside down.
+//
+func (q slquaternion) upz() float64 {
+	x, y, z, s := float64(q.X), float64(q.Y), float64(q.Z), float64(q.S)
+	return (s*s - x*x - y*y + z*z) / (x*x + y*y + z*z + s*s)
+}
+
+//
+//  heading -- compass direction of forward, degrees, counterclockwise from east
+//
+func (q slquaternion) heading() float64 {
+	fx, fy, _ := q.forward()
+	return math.Atan2(fy, fx) * 180 / math.Pi
+}
+
+//
+//  speed -- magnitude of velocity, meters/sec
+//
+func (v slvector) speed() float64 {
+	return math.Sqrt(float64(v.X)*float64(v.X) + float64(v.Y)*float64(v.Y) + float64(v.Z)*float64(v.Z))
+}
+
+//
+//  anglebetween -- smallest angle between two compass directions, degrees, 0 to 180
+//
+func anglebetween(a float64, b float64) float64 {
+	d := math.Mod(math.Abs(a-b), 360)
+	if d > 180 {
+		d = 360 - d
+	}
+	return d
+}
+
+//
+//  updatemotion -- speed, turning, flips and spins, from one event
+//
+//  Events without a rotation, as from before rotations were logged, are
+//  skipped. A flip or spin counts once, when it starts.
+//
+func (r *trip) updatemotion(event vehlogevent, hdr slheader) {
+	q := hdr.Local_rotation
+	if !q.known() {
+		return
+	}
+	speed := hdr.Local_velocity.speed()
+	r.speedsamples++
+	r.sx.max_speed = math.Max(r.sx.max_speed, speed)
+	r.sx.avg_speed += (speed - r.sx.avg_speed) / float64(r.speedsamples) // running mean
+	heading := q.heading()
+	if r.speedsamples > 1 {
+		r.sx.heading_change += anglebetween(heading, r.prevheading)
+	}
+	r.prevheading = heading
+	flipped := q.upz() < 0
+	if flipped && !r.flipped {
+		r.sx.flips++
+		r.addfault("Flipped over in " + hdr.Region.Name)
+	}
+	r.flipped = flipped
+	hspeed := math.Hypot(float64(hdr.Local_velocity.X), float64(hdr.Local_velocity.Y))
+	travel := math.Atan2(float64(hdr.Local_velocity.Y), float64(hdr.Local_velocity.X)) * 180 / math.Pi
+	spinning := hspeed >= spinminspeed && anglebetween(heading, travel) >= spindegrees
+	if spinning && !r.spinning {
+		r.sx.spins++
+		r.addfault("Spun out in " + hdr.Region.Name)
+	}
+	r.spinning = spinning
+}
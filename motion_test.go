@@ -0,0 +1,143 @@
+//
+//  Tests for velocity and rotation
+//
+package main
+
+import (
+	"math"
+	"net/http"
+	"testing"
+)
+
+const sqrthalf = 0.70710678
+
+func TestParseMotionHeaders(t *testing.T) {
+	hdr, err := Parseheader(testheader1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Local_rotation != (slquaternion{0, 0, 0, 1}) || hdr.Local_velocity != (slvector{}) {
+		t.Errorf("Rotation %s, velocity %s", hdr.Local_rotation, hdr.Local_velocity)
+	}
+	bad := http.Header{}
+	for k, v := range testheader1 {
+		bad[k] = v
+	}
+	bad.Set("X-Secondlife-Local-Rotation", "(0.0, 0.0, 1.0)")
+	if _, err := Parseheader(bad); err == nil {
+		t.Errorf("Bad rotation accepted")
+	} else if _, ok := err.(*headererror); !ok {
+		t.Errorf("Bad rotation: got %T, expected header error", err)
+	}
+	bad.Del("X-Secondlife-Local-Rotation") // not sent, as by some grids
+	bad.Del("X-Secondlife-Local-Velocity")
+	if hdr, err := Parseheader(bad); err != nil || hdr.Local_rotation.known() {
+		t.Errorf("Without motion headers: rotation %s, err %v", hdr.Local_rotation, err)
+	}
+}
+
+func TestQuaternion(t *testing.T) {
+	tests := []struct {
+		q       slquaternion
+		heading float64
+		upz     float64
+	}{
+		{slquaternion{0, 0, 0, 1}, 0, 1},                // facing east
+		{slquaternion{0, 0, sqrthalf, sqrthalf}, 90, 1}, // turned left, facing north
+		{slquaternion{0, 0, 1, 0}, 180, 1},              // facing west
+		{slquaternion{1, 0, 0, 0}, 0, -1},               // rolled over
+		{slquaternion{0, sqrthalf, 0, sqrthalf}, 0, 0},  // nose down
+	}
+	for _, test := range tests {
+		if h := test.q.heading(); anglebetween(h, test.heading) > 1e-4 {
+			t.Errorf("%s: heading %f, expected %f", test.q, h, test.heading)
+		}
+		if u := test.q.upz(); math.Abs(u-test.upz) > 1e-4 {
+			t.Errorf("%s: up %f, expected %f", test.q, u, test.upz)
+		}
+	}
+	if a := anglebetween(170, -170); math.Abs(a-20) > 1e-9 {
+		t.Errorf("Angle between 170 and -170: %f, expected 20", a)
+	}
+}
+
+//
+//  motionsteps -- a drive east, a left turn, a rollover, and a spin
+//
+var motionsteps = []struct {
+	eventtype string
+	velocity  slvector
+	rotation  slquaternion
+}{
+	{"STARTUP", slvector{0, 0, 0}, slquaternion{0, 0, 0, 1}},
+	{"TICK", slvector{10, 0, 0}, slquaternion{0, 0, 0, 1}},
+	{"TICK", slvector{0, 20, 0}, slquaternion{0, 0, sqrthalf, sqrthalf}}, // turned north
+	{"TICK", slvector{0, 2, 0}, slquaternion{}},                          // no rotation sent
+	{"TICK", slvector{0, 2, 0}, slquaternion{sqrthalf, sqrthalf, 0, 0}},  // upside down, facing north
+	{"TICK", slvector{0, 2, 0}, slquaternion{sqrthalf, sqrthalf, 0, 0}},  // still
+	{"TICK", slvector{0, 8, 0}, slquaternion{0, 0, 0, 1}},                // facing east, going north
+	{"SHUTDOWN", slvector{0, 0, 0}, slquaternion{0, 0, sqrthalf, sqrthalf}},
+}
+
+func motionevents(tripid string) []tripevent {
+	var events []tripevent
+	for i, step := range motionsteps {
+		hdr, ev := testevent(tripid, int32(i))
+		hdr.Local_velocity, hdr.Local_rotation = step.velocity, step.rotation
+		ev.Eventtype = step.eventtype
+		ev.Timestamp += int64(i)
+		events = append(events, tripevent{hdr: hdr, ev: ev})
+	}
+	return events
+}
+
+//
+//  checkmotionsummary -- summary of motionevents
+//
+func checkmotionsummary(t *testing.T, r tripsummary) {
+	if r.flips != 1 || r.spins != 1 || r.trip_status != "FAULT" || r.msg != "Flipped over in Vallone; Spun out in Vallone" {
+		t.Errorf("Flips %d, spins %d, status %s, msg \"%s\"", r.flips, r.spins, r.trip_status, r.msg)
+	}
+	if math.Abs(r.max_speed-20) > 1e-4 || math.Abs(r.avg_speed-6) > 1e-4 { // 0+10+20+2+2+8+0 over 7
+		t.Errorf("Speed: max %f, mean %f, expected 20, 6", r.max_speed, r.avg_speed)
+	}
+	if math.Abs(r.heading_change-270) > 1e-3 { // left 90, right 90, left 90
+		t.Errorf("Heading change %f, expected 270", r.heading_change)
+	}
+}
+
+func TestMotion(t *testing.T) {
+	var tr trip
+	for i, te := range motionevents("x") {
+		tr.updatefromevent(te.ev, te.hdr, i == 0)
+	}
+	checkmotionsummary(t, tr.sx)
+}
+
+//
+//  checkmotion -- velocity and rotation are stored with events, and speed statistics with the trip
+//
+func checkmotion(t *testing.T, store vehstore) {
+	tripid := GenerateRandomTripid()
+	events := motionevents(tripid)
+	if _, err := store.appendevents(events, usednonce{}); err != nil {
+		t.Fatal(err)
+	}
+	te, err := store.loadevent(tripid, 4)
+	if err != nil || te.hdr.Local_velocity != events[4].hdr.Local_velocity || te.hdr.Local_rotation != events[4].hdr.Local_rotation {
+		t.Errorf("Event read back: velocity %s, rotation %s, err %v", te.hdr.Local_velocity, te.hdr.Local_rotation, err)
+	}
+	agetodo(t, store)
+	if n, err := dosummarize(store, "test", false); n != 1 || err != nil {
+		t.Fatalf("Summarized %d trips, err %v, expected 1", n, err)
+	}
+	r, err := store.loadtripsummary(tripid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkmotionsummary(t, r)
+}
+
+func TestMotionStored(t *testing.T) {
+	forstores(t, checkmotion)
+}
@@ -0,0 +1,117 @@
+//
+//  Tests for owner and object keys
+//
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseKeyHeaders(t *testing.T) {
+	hdrs := http.Header{}
+	for k, v := range testheader1 {
+		hdrs[k] = v
+	}
+	hdrs.Set("X-Secondlife-Object-Key", "B23730F8-4105-594A-C359-E72F9FECE699")
+	hdr, err := Parseheader(hdrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Object_key != "b23730f8-4105-594a-c359-e72f9fece699" || hdr.Owner_key != "dadec334-539a-4875-ad0e-d9654705f437" {
+		t.Errorf("Keys: owner %s, object %s", hdr.Owner_key, hdr.Object_key)
+	}
+	for _, bad := range []string{"", "not a key", "b23730f8-4105-594a-c359-e72f9fece69", "b23730f8x4105-594a-c359-e72f9fece699", "g23730f8-4105-594a-c359-e72f9fece699"} {
+		hdrs.Set("X-Secondlife-Owner-Key", bad)
+		if _, err := Parseheader(hdrs); err == nil {
+			t.Errorf("Owner key \"%s\" accepted", bad)
+		} else if _, ok := err.(*headererror); !ok {
+			t.Errorf("Owner key \"%s\": got %T, expected header error", bad, err)
+		}
+	}
+	hdrs.Set("X-Secondlife-Owner-Key", "dadec334-539a-4875-ad0e-d9654705f437")
+	hdrs.Del("X-Secondlife-Object-Key")
+	if _, err := Parseheader(hdrs); err == nil {
+		t.Errorf("Missing object key accepted")
+	}
+}
+
+//
+//  renamedevents -- a trip where the object is renamed partway, and maybe replaced
+//
+func renamedevents(tripid string, newkey string) []tripevent {
+	var events []tripevent
+	for i := int32(0); i < 3; i++ {
+		hdr, ev := testevent(tripid, i)
+		ev.Timestamp += int64(i)
+		switch i {
+		case 1:
+			ev.Eventtype = "TICK"
+		case 2:
+			ev.Eventtype = "SHUTDOWN"
+			hdr.Object_name = "Logging tester 0.5"
+			hdr.Owner_name = "Animats Resident"
+			hdr.Object_key = newkey
+		}
+		events = append(events, tripevent{hdr: hdr, ev: ev})
+	}
+	return events
+}
+
+func TestRenamedObject(t *testing.T) {
+	var tr trip
+	for i, te := range renamedevents("x", "b23730f8-4105-594a-c359-e72f9fece699") {
+		tr.updatefromevent(te.ev, te.hdr, i == 0)
+	}
+	if tr.sx.data_status != "OK" {
+		t.Errorf("Renamed object: data status %s, expected OK", tr.sx.data_status)
+	}
+	tr = trip{}
+	for i, te := range renamedevents("x", "0e9ebf4b-0d3a-4b5a-9f4e-1b7e1f4a6c11") {
+		tr.updatefromevent(te.ev, te.hdr, i == 0)
+	}
+	if tr.sx.data_status != "INCONSISTENT" {
+		t.Errorf("Different object: data status %s, expected INCONSISTENT", tr.sx.data_status)
+	}
+	tr = trip{}
+	for i, te := range renamedevents("x", "") { // logged before keys were
+		te.hdr.Owner_key, te.hdr.Object_key = "", ""
+		tr.updatefromevent(te.ev, te.hdr, i == 0)
+	}
+	if tr.sx.data_status != "INCONSISTENT" {
+		t.Errorf("Renamed object without keys: data status %s, expected INCONSISTENT", tr.sx.data_status)
+	}
+}
+
+//
+//  checkobjectkeys -- keys are stored with events and trips, and trips found by key
+//
+func checkobjectkeys(t *testing.T, store vehstore) {
+	tripid := GenerateRandomTripid()
+	events := renamedevents(tripid, "b23730f8-4105-594a-c359-e72f9fece699")
+	if _, err := store.appendevents(events, usednonce{}); err != nil {
+		t.Fatal(err)
+	}
+	te, err := store.loadevent(tripid, 2)
+	if err != nil || te.hdr.Object_key != events[2].hdr.Object_key || te.hdr.Owner_key != events[2].hdr.Owner_key {
+		t.Errorf("Event read back: owner key %s, object key %s, err %v", te.hdr.Owner_key, te.hdr.Object_key, err)
+	}
+	agetodo(t, store)
+	if n, err := dosummarize(store, "test", false); n != 1 || err != nil {
+		t.Fatalf("Summarized %d trips, err %v, expected 1", n, err)
+	}
+	trips, err := store.findtrips(tripfilter{object_key: "b23730f8-4105-594a-c359-e72f9fece699", owner_key: "dadec334-539a-4875-ad0e-d9654705f437"})
+	if err != nil || len(trips) != 1 || trips[0].tripid != tripid || trips[0].object_name != "Logging tester 0.4" {
+		t.Fatalf("Found %d trips by key, err %v, expected 1", len(trips), err)
+	}
+	if r := trips[0]; r.data_status != "OK" || r.object_key != "b23730f8-4105-594a-c359-e72f9fece699" {
+		t.Errorf("Trip by key: data status %s, object key %s", r.data_status, r.object_key)
+	}
+	if trips, _ := store.findtrips(tripfilter{object_key: "0e9ebf4b-0d3a-4b5a-9f4e-1b7e1f4a6c11"}); len(trips) != 0 {
+		t.Errorf("Found %d trips by another object's key, expected 0", len(trips))
+	}
+}
+
+func TestObjectKeys(t *testing.T) {
+	forstores(t, checkobjectkeys)
+}
@@ -0,0 +1,276 @@
+//
+//  rebuild -- recompute stored trip summaries from raw events
+//
+//  After a change to the summarization rules, "vehiclelogserver rebuild"
+//  applies them to history. With -dry-run it only prints what would change.
+//  A checkpoint file lists the trips done, so an interrupted rebuild can
+//  be run again and pick up where it stopped.
+//
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+//
+//  Constants
+//
+const defaultprogress = 100 // report progress every N trips
+const dateformat = "2006-01-02"
+
+//
+//  rebuildoptions -- what to rebuild, and how
+//
+type rebuildoptions struct {
+	filter     tripfilter // trips to rebuild
+	dryrun     bool       // print differences, don't write
+	checkpoint string     // file of trip IDs done, if any
+	progress   int        // report every N trips
+	out        io.Writer  // for reports
+}
+
+//
+//  rebuildcount -- results of a rebuild
+//
+type rebuildcount struct {
+	selected int // trips matching filter
+	skipped  int // done by an earlier run, per checkpoint
+	rebuilt  int // recomputed
+	changed  int // recomputed summary differs from stored one
+	failed   int // couldn't be recomputed
+}
+
+func (c rebuildcount) String() string {
+	return fmt.Sprintf("%d trips selected, %d already done, %d rebuilt, %d changed, %d failed",
+		c.selected, c.skipped, c.rebuilt, c.changed, c.failed)
+}
+
+//
+//  tripdiff -- differences between two trip summaries, as "field: old -> new"
+//
+//  Ignores the fields kept by the store. Floats are compared to the
+//  precision of the database's FLOAT columns.
+//
+func tripdiff(a tripsummary, b tripsummary) []string {
+	var diffs []string
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	for i := 0; i < va.NumField(); i++ {
+		name := va.Type().Field(i).Name
+		switch name {
+		case "stamp", "revision", "recomputed": // same trip end, or set by store
+			continue
+		}
+		sa, sb := fieldstring(va.Field(i)), fieldstring(vb.Field(i))
+		if sa != sb {
+			diffs = append(diffs, fmt.Sprintf("%s: %s -> %s", name, sa, sb))
+		}
+	}
+	return diffs
+}
+
+//
+//  fieldstring -- printable value of a summary field
+//
+func fieldstring(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return fmt.Sprintf("%.6g", v.Float())
+	case reflect.Struct: // positions, segments, crossings, falls
+		var parts []string
+		for i := 0; i < v.NumField(); i++ {
+			parts = append(parts, fieldstring(v.Field(i)))
+		}
+		return "(" + strings.Join(parts, ", ") + ")"
+	case reflect.Slice: // segments, crossings, falls
+		if v.Type().Elem().Kind() != reflect.Struct {
+			break
+		}
+		var parts []string
+		for i := 0; i < v.Len(); i++ {
+			parts = append(parts, fieldstring(v.Index(i)))
+		}
+		return "[" + strings.Join(parts, " ") + "]"
+	}
+	return fmt.Sprint(v)
+}
+
+//
+//  readcheckpoint -- trip IDs listed in checkpoint file. None if no file.
+//
+func readcheckpoint(path string) (map[string]bool, error) {
+	done := make(map[string]bool)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return done, nil // new rebuild
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if tripid := strings.TrimSpace(scanner.Text()); tripid != "" {
+			done[tripid] = true
+		}
+	}
+	return done, scanner.Err()
+}
+
+//
+//  rebuildtrips -- recompute selected trip summaries
+//
+//  A trip which fails is reported and logged, and the rebuild goes on.
+//  Stops after the current trip at shutdown.
+//
+func rebuildtrips(store vehstore, opts rebuildoptions) (rebuildcount, error) {
+	var count rebuildcount
+	if opts.progress <= 0 {
+		opts.progress = defaultprogress
+	}
+	trips, err := store.findtrips(opts.filter)
+	if err != nil {
+		return count, err
+	}
+	count.selected = len(trips)
+	done := make(map[string]bool)
+	var checkpoint *os.File
+	if opts.checkpoint != "" {
+		done, err = readcheckpoint(opts.checkpoint)
+		if err != nil {
+			return count, err
+		}
+		if !opts.dryrun {
+			checkpoint, err = os.OpenFile(opts.checkpoint, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				return count, err
+			}
+			defer checkpoint.Close()
+		}
+	}
+	for i, old := range trips {
+		if isshuttingdown() {
+			return count, errors.New("Rebuild interrupted. Run again with the same checkpoint file to finish.")
+		}
+		if i > 0 && i%opts.progress == 0 {
+			fmt.Fprintf(opts.out, "%d of %d: %s\n", i, len(trips), count)
+		}
+		if done[old.tripid] {
+			count.skipped++
+			continue
+		}
+		if old.segments, err = store.tripsegments(old.tripid); err != nil {
+			return count, err // database trouble; stop
+		}
+		if old.crossings, err = store.tripcrossings(old.tripid); err != nil {
+			return count, err
+		}
+		if old.falls, err = store.tripfalls(old.tripid); err != nil {
+			return count, err
+		}
+		r, err := summarizetrip(store, old.tripid, old.stamp, false)
+		if err != nil {
+			count.failed++
+			fmt.Fprintf(opts.out, "Trip %s: %s\n", old.tripid, err)
+			logsummarizeerror(store, old.tripid, err)
+			continue
+		}
+		count.rebuilt++
+		diffs := tripdiff(old, r)
+		if len(diffs) > 0 {
+			count.changed++
+			if opts.dryrun {
+				fmt.Fprintf(opts.out, "Trip %s:\n  %s\n", old.tripid, strings.Join(diffs, "\n  "))
+			}
+		}
+		if opts.dryrun {
+			continue
+		}
+		if err := store.rebuildtripsummary(r); err != nil {
+			return count, err // database trouble; stop
+		}
+		if checkpoint != nil {
+			if _, err := fmt.Fprintln(checkpoint, old.tripid); err != nil {
+				return count, err
+			}
+		}
+	}
+	return count, nil
+}
+
+//
+//  parsedate -- YYYY-MM-DD, UTC. Zero time if empty.
+//
+func parsedate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(dateformat, s)
+}
+
+//
+//  rebuildcommand -- "vehiclelogserver rebuild [flags]"
+//
+func rebuildcommand(args []string) error {
+	flags := flag.NewFlagSet("rebuild", flag.ContinueOnError)
+	cfile := flags.String("config", configloc, "configuration file")
+	all := flags.Bool("all", false, "rebuild all trips, if no other selection is given")
+	from := flags.String("from", "", "trips ending on or after this date, YYYY-MM-DD")
+	to := flags.String("to", "", "trips ending on or before this date, YYYY-MM-DD")
+	owner := flags.String("owner", "", "trips by this owner name")
+	ownerkey := flags.String("ownerkey", "", "trips by this owner key")
+	object := flags.String("object", "", "trips by this object name")
+	objectkey := flags.String("objectkey", "", "trips by this object key")
+	status := flags.String("status", "", "trips with this trip status: OK, FAULT, or NOSHUTDOWN")
+	grid := flags.String("grid", "", "trips on this grid")
+	dryrun := flags.Bool("dry-run", false, "print changes without writing them")
+	checkpoint := flags.String("checkpoint", "", "file of trips done, for resuming")
+	progress := flags.Int("progress", defaultprogress, "report progress every N trips")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	opts := rebuildoptions{dryrun: *dryrun, checkpoint: *checkpoint, progress: *progress, out: os.Stdout}
+	f := &opts.filter
+	f.owner_name, f.object_name, f.trip_status, f.grid = *owner, *object, *status, *grid
+	f.owner_key, f.object_key = strings.ToLower(*ownerkey), strings.ToLower(*objectkey)
+	var err error
+	if f.since, err = parsedate(*from); err != nil {
+		return err
+	}
+	if f.until, err = parsedate(*to); err != nil {
+		return err
+	}
+	if !f.until.IsZero() {
+		f.until = f.until.AddDate(0, 0, 1) // through the end of that day
+	}
+	if !*all && *from == "" && *to == "" && *owner == "" && *object == "" && *status == "" && *grid == "" &&
+		*ownerkey == "" && *objectkey == "" {
+		return errors.New("No trips selected. Use -all to rebuild every trip.")
+	}
+	sv := new(FastCGIServer)
+	if err := initdb(*cfile, sv); err != nil {
+		return err
+	}
+	defer sv.store.close()
+	go func() { // finish current trip on interrupt
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-sigs
+		log.Printf("Received %s, stopping after current trip.", sig)
+		atomic.StoreInt32(&shuttingdown, 1)
+	}()
+	count, err := rebuildtrips(sv.store, opts)
+	fmt.Printf("Done: %s\n", count)
+	return err
+}
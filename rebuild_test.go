@@ -0,0 +1,135 @@
+//
+//  Tests for rebuilding trip summaries
+//
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//
+//  addsummarizedtrip -- a one minute trip, summarized
+//
+func addsummarizedtrip(t *testing.T, store vehstore, owner string) string {
+	tripid := GenerateRandomTripid()
+	for i, eventtype := range []string{"STARTUP", "SHUTDOWN"} {
+		hdr, ev := testevent(tripid, int32(i))
+		hdr.Owner_name = owner
+		ev.Eventtype = eventtype
+		ev.Timestamp += int64(60 * i)
+		mustappend(t, store, hdr, ev)
+	}
+	agetodo(t, store)
+	if _, err := dosummarize(store, "test", false); err != nil {
+		t.Fatal(err)
+	}
+	return tripid
+}
+
+func checkrebuild(t *testing.T, store vehstore) {
+	defer func(pause time.Duration) { summarizepause = pause }(summarizepause)
+	summarizepause = 0
+	stale := addsummarizedtrip(t, store, "animats Resident")
+	addsummarizedtrip(t, store, "animats Resident")
+	addsummarizedtrip(t, store, "Someone Else")
+	//  Stored summary made under old rules
+	r, _ := store.loadtripsummary(stale)
+	r.elapsed = 999
+	store.rebuildtripsummary(r)
+	//  Dry run reports, doesn't write
+	var out bytes.Buffer
+	opts := rebuildoptions{filter: tripfilter{owner_name: "animats Resident"}, dryrun: true, out: &out}
+	count, err := rebuildtrips(store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count.selected != 2 || count.rebuilt != 2 || count.changed != 1 {
+		t.Errorf("Dry run: %s", count)
+	}
+	if !strings.Contains(out.String(), stale) || !strings.Contains(out.String(), "elapsed: 999 -> 60") {
+		t.Errorf("Dry run output: %s", out.String())
+	}
+	if r, _ = store.loadtripsummary(stale); r.elapsed != 999 {
+		t.Errorf("Dry run changed trip")
+	}
+	//  Real run, with checkpoint
+	dir, err := ioutil.TempDir("", "vehiclelogtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts.dryrun = false
+	opts.checkpoint = filepath.Join(dir, "checkpoint")
+	count, err = rebuildtrips(store, opts)
+	if err != nil || count.rebuilt != 2 || count.changed != 1 {
+		t.Errorf("Rebuild: %s, %v", count, err)
+	}
+	if r, _ = store.loadtripsummary(stale); r.elapsed != 60 || r.revision != 3 {
+		t.Errorf("Rebuilt trip: elapsed %d, revision %d, expected 60, 3", r.elapsed, r.revision)
+	}
+	//  Run again, nothing left to do
+	count, err = rebuildtrips(store, opts)
+	if err != nil || count.skipped != 2 || count.rebuilt != 0 {
+		t.Errorf("Resumed rebuild: %s, %v", count, err)
+	}
+	//  Selection by date and status
+	count, _ = rebuildtrips(store, rebuildoptions{filter: tripfilter{until: time.Now().Add(-24 * time.Hour)}, dryrun: true, out: &out})
+	if count.selected != 0 {
+		t.Errorf("Selected %d trips ending before yesterday", count.selected)
+	}
+	count, _ = rebuildtrips(store, rebuildoptions{filter: tripfilter{trip_status: "OK"}, dryrun: true, out: &out})
+	if count.selected != 3 {
+		t.Errorf("Selected %d trips with status OK, expected 3", count.selected)
+	}
+	//  Rebuild while a summarizer holds a trip's lease
+	hdr, ev := testevent(stale, 2)
+	ev.Eventtype = "SHUTDOWN"
+	if err := store.appendevent(hdr, ev, usednonce{}); err != nil {
+		t.Fatal(err)
+	}
+	agetodo(t, store)
+	if id, _, err := store.claimtrip("worker1", 60); id != stale || err != nil {
+		t.Fatalf("Claim failed: \"%s\", %v", id, err)
+	}
+	if _, err := rebuildtrips(store, rebuildoptions{filter: tripfilter{owner_name: "animats Resident"}, out: &out}); err != nil {
+		t.Fatal(err)
+	}
+	if id, _, err := store.claimtrip("worker2", 60); err != errNoPendingTrip {
+		t.Errorf("Rebuild released summarizer's lease: \"%s\" claimed, %v", id, err)
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	forstores(t, checkrebuild)
+}
+
+func TestTripDiff(t *testing.T) {
+	a := tripsummary{tripid: "x", distance: 21.2551, last_eventtypes: []string{"STARTUP", "SHUTDOWN"}, revision: 1}
+	b := a
+	b.distance = float64(float32(a.distance)) // as read back from a FLOAT column
+	b.revision = 2
+	if diffs := tripdiff(a, b); len(diffs) != 0 {
+		t.Errorf("Unexpected differences: %v", diffs)
+	}
+	b.min_pos.X = 5
+	b.last_eventtypes = []string{"STARTUP"}
+	if diffs := tripdiff(a, b); len(diffs) != 2 || diffs[0] != "min_pos: (0, 0, 0) -> (5, 0, 0)" {
+		t.Errorf("Differences: %v", diffs)
+	}
+	a.segments = []tripsegment{{tripid: "x", region_name: "Vallone", distance: 12.5, events: 2}}
+	b = a
+	b.segments = []tripsegment{{tripid: "x", region_name: "Vallone", distance: float64(float32(12.5)), events: 2}}
+	if diffs := tripdiff(a, b); len(diffs) != 0 {
+		t.Errorf("Unexpected segment differences: %v", diffs)
+	}
+	b.segments = append(b.segments, tripsegment{tripid: "x", seq: 1, region_name: "Jeogeot"})
+	if diffs := tripdiff(a, b); len(diffs) != 1 || !strings.HasPrefix(diffs[0], "segments: ") {
+		t.Errorf("Segment differences: %v", diffs)
+	}
+}
@@ -0,0 +1,178 @@
+//
+//  replay -- protection against captured log messages being sent again
+//
+//  The legacy signature is SHA1(secret + body). It says nothing about who
+//  sent the message, or when, so a captured request can be replayed
+//  forever, or sent again with different X-Secondlife-* headers.
+//
+//  The current signature is SHA1(secret + payload), where the payload is
+//
+//    owner key \n object key \n region \n position \n time \n nonce \n body
+//
+//  with the keys in lower case, as LSL gives them, the region and position
+//  exactly as sent in X-Secondlife-Region and X-Secondlife-Local-Position,
+//  less leading and trailing spaces, so the region corner is covered too,
+//
+//    Vallone (462592, 306944)
+//    (204.783539, 26.682831, 35.563702)
+//
+//  the time in UNIX seconds sent as X-Authtoken-Time, and a nonce, such as
+//  from llGenerateKey, sent as X-Authtoken-Nonce. Velocity and rotation are
+//  not signed, as the simulator fills them in when the request is sent.
+//  The server rejects messages whose time is too far from its own. Each
+//  nonce is stored in the nonces table, in the same transaction as the
+//  message's events, and the table allows a key's nonce only once, so a
+//  replay is rejected by whichever server process gets it. Rows are
+//  deleted once their signed time is too old to be accepted.
+//  A script which never got a reply may send the same signed request
+//  again. If its events are all stored, that is a harmless resend, and
+//  each event gets "duplicate", or "conflict" again, as it would any other
+//  time; otherwise a used nonce is a replay. A script retrying after an
+//  error must sign again with a new time and nonce.
+//
+//  Legacy signatures are accepted only if "Auth": {"Legacy": true} is in
+//  the config.
+//
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//
+//  Constants
+//
+const defaultmaxagesecs = 300 // signed time this far from server time is rejected
+const minnoncelen = 8         // a UUID is 36
+const maxnoncelen = 64
+
+//
+//  signedheaders -- the time and nonce of a signed message
+//
+type signedheaders struct {
+	legacy bool      // old signature of the body alone
+	stamp  time.Time // X-Authtoken-Time
+	nonce  string    // X-Authtoken-Nonce
+}
+
+//
+//  signedpayload -- what the message signature covers
+//
+//  Messages without X-Authtoken-Time are legacy, if config allows them.
+//
+func signedpayload(bodycontent []byte, headervars http.Header, config vdbconfig) ([]byte, signedheaders, error) {
+	var sh signedheaders
+	stamp := strings.TrimSpace(headervars.Get("X-Authtoken-Time"))
+	if stamp == "" {
+		if !config.Auth.Legacy {
+			return nil, sh, &autherror{true, errors.New("No X-Authtoken-Time. Messages without a signed time and nonce are not accepted.")}
+		}
+		sh.legacy = true
+		return bodycontent, sh, nil
+	}
+	secs, err := strconv.ParseInt(stamp, 10, 64)
+	if err != nil {
+		return nil, sh, &autherror{true, fmt.Errorf("X-Authtoken-Time \"%s\" is not a UNIX time", stamp)}
+	}
+	sh.stamp = time.Unix(secs, 0)
+	sh.nonce = strings.TrimSpace(headervars.Get("X-Authtoken-Nonce"))
+	if len(sh.nonce) < minnoncelen || len(sh.nonce) > maxnoncelen {
+		return nil, sh, &autherror{true, fmt.Errorf("X-Authtoken-Nonce \"%s\" must be %d to %d characters", sh.nonce, minnoncelen, maxnoncelen)}
+	}
+	fields := []string{ // header values are checked by Parseheader, once the signature is good
+		strings.ToLower(strings.TrimSpace(headervars.Get("X-Secondlife-Owner-Key"))),
+		strings.ToLower(strings.TrimSpace(headervars.Get("X-Secondlife-Object-Key"))),
+		strings.TrimSpace(headervars.Get("X-Secondlife-Region")),
+		strings.TrimSpace(headervars.Get("X-Secondlife-Local-Position")),
+		stamp, sh.nonce}
+	payload := append([]byte(strings.Join(fields, "\n")+"\n"), bodycontent...)
+	return payload, sh, nil
+}
+
+//
+//  usednonce -- the nonce of a signed message, stored with its events
+//
+//  Zero for a legacy message, which has none.
+//
+type usednonce struct {
+	key_name string    // auth key which signed the message
+	nonce    string    // X-Authtoken-Nonce
+	stamp    time.Time // X-Authtoken-Time
+}
+
+//
+//  noncewindow -- how far signed time may be from server time, and when used nonces were last pruned
+//
+type noncewindow struct {
+	maxage time.Duration // messages older or newer than this are rejected
+	pruned int64         // time bucket of last prune, atomic
+}
+
+func newnoncewindow(maxagesecs int) *noncewindow {
+	if maxagesecs <= 0 {
+		maxagesecs = defaultmaxagesecs
+	}
+	return &noncewindow{maxage: time.Duration(maxagesecs) * time.Second}
+}
+
+//
+//  checkfresh -- reject a message signed too far from server time
+//
+func (w *noncewindow) checkfresh(sh signedheaders, now time.Time) error {
+	age := now.Sub(sh.stamp)
+	if age > w.maxage || age < -w.maxage {
+		return &autherror{true, fmt.Errorf("Signed time %d is %1.0f secs from server time; stale or replayed message",
+			sh.stamp.Unix(), age.Seconds())}
+	}
+	return nil
+}
+
+//
+//  prune -- delete stored nonces too old to be accepted, once per maxage time bucket
+//
+//  Any server process may do this. Failure is only reported locally;
+//  the rows will go next time.
+//
+func (w *noncewindow) prune(store vehstore, now time.Time) {
+	bucket := now.Unix() / int64(w.maxage/time.Second)
+	last := atomic.LoadInt64(&w.pruned)
+	if bucket == last || !atomic.CompareAndSwapInt64(&w.pruned, last, bucket) {
+		return // done this bucket, or another request is doing it
+	}
+	if err := store.prunenonces(now.Add(-w.maxage)); err != nil {
+		log.Printf("Unable to prune nonces: %s", err)
+	}
+}
+
+//
+//  nonces -- the replay window for this process. Set from config by initserver.
+//
+var nonces = newnoncewindow(0)
+
+//
+//  Authenticate -- check the signature of a message, then that it is fresh
+//
+//  The nonce to store with the message's events is returned in the match.
+//  It is stored only with events, so forged or rejected messages can't
+//  use nonces up; the store returns errReplayedNonce if it was used before.
+//
+func Authenticate(bodycontent []byte, headervars http.Header, config vdbconfig) (authmatch, error) {
+	name := strings.TrimSpace(headervars.Get("X-Authtoken-Name"))
+	payload, sh, err := signedpayload(bodycontent, headervars, config)
+	if err != nil {
+		return authmatch{name: name}, err
+	}
+	match, err := Validateauthtoken(payload, name, strings.TrimSpace(headervars.Get("X-Authtoken-Hash")), config)
+	if err != nil || sh.legacy {
+		return match, err
+	}
+	match.nonce = usednonce{key_name: name, nonce: sh.nonce, stamp: sh.stamp}
+	return match, nonces.checkfresh(sh, servernow())
+}
@@ -0,0 +1,226 @@
+//
+//  Tests for replay protection
+//
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+//
+//  signcurrent -- copy of testheader1, signed for body in the current format
+//
+func signcurrent(body []byte, stamp int64, nonce string) http.Header {
+	hdr := http.Header{}
+	for k, v := range testheader1 {
+		hdr[k] = v
+	}
+	payload := fmt.Sprintf("%s\n%s\n%s\n%s\n%d\n%s\n%s", "dadec334-539a-4875-ad0e-d9654705f437",
+		"b23730f8-4105-594a-c359-e72f9fece699", "Vallone (462592, 306944)", "(204.783539, 26.682831, 35.563702)",
+		stamp, nonce, body)
+	hdr.Set("X-Authtoken-Name", testtokenname)
+	hdr.Set("X-Authtoken-Hash", Hashwithtoken([]byte(testsecret), []byte(payload)))
+	hdr.Set("X-Authtoken-Time", fmt.Sprintf("%d", stamp))
+	hdr.Set("X-Authtoken-Nonce", nonce)
+	return hdr
+}
+
+func TestReplayProtection(t *testing.T) {
+	config := testconfig()
+	config.Auth.Legacy = false
+	sv := new(FastCGIServer)
+	if err := initserver(config, sv); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	testjson := []byte(strings.Replace(testjson1, "TRIPID", GenerateRandomTripid(), 1))
+	otherjson := []byte(strings.Replace(testjson1, "TRIPID", GenerateRandomTripid(), 1))
+	tests := []struct {
+		what   string
+		body   []byte
+		hdr    http.Header
+		status string
+	}{
+		{"Signed event", testjson, signcurrent(testjson, now, "0e9ebf4b-0d3a-4b5a-9f4e-1b7e1f4a6c11"), statusok},
+		{"Same signed request again", testjson, signcurrent(testjson, now, "0e9ebf4b-0d3a-4b5a-9f4e-1b7e1f4a6c11"), statusduplicate},
+		{"Nonce used for another event", otherjson, signcurrent(otherjson, now, "0e9ebf4b-0d3a-4b5a-9f4e-1b7e1f4a6c11"), statusbadauth},
+		{"Resent event, signed again", testjson, signcurrent(testjson, now+1, "5b1f2c4e-7a33-4c1d-8e2f-0d9a6b3c7e21"), statusduplicate},
+		{"Stale event", testjson, signcurrent(testjson, now-defaultmaxagesecs-60, "7c2d9e1a-4b6f-4a8e-9d3c-2f1e0b5a6c44"), statusbadauth},
+		{"Future event", testjson, signcurrent(testjson, now+defaultmaxagesecs+60, "8d3e0f2b-5c7a-4b9f-ae4d-3a2f1c6b7d55"), statusbadauth},
+		{"Short nonce", testjson, signcurrent(testjson, now, "abc"), statusbadauth},
+		{"Legacy signature", testjson, signedheader(testjson), statusbadauth},
+	}
+	for _, test := range tests {
+		if code, reply := postevent(t, sv, test.body, test.hdr); reply.Status != test.status {
+			t.Errorf("%s: got %d %s, expected %s", test.what, code, reply.Status, test.status)
+		}
+	}
+	//  Signed headers can't be changed
+	for _, change := range []struct{ field, value string }{
+		{"X-Secondlife-Owner-Key", "0e9ebf4b-0d3a-4b5a-9f4e-1b7e1f4a6c11"},
+		{"X-Secondlife-Object-Key", "0e9ebf4b-0d3a-4b5a-9f4e-1b7e1f4a6c11"},
+		{"X-Secondlife-Region", "Hathian (462848, 306944)"},
+		{"X-Secondlife-Region", "Vallone (462848, 306944)"}, // same name, other corner
+		{"X-Secondlife-Local-Position", "(10.0, 26.682831, 35.563702)"},
+		{"X-Authtoken-Time", fmt.Sprintf("%d", now+2)},
+	} {
+		hdr := signcurrent(testjson, now, fmt.Sprintf("changed-%s", change.field))
+		hdr.Set(change.field, change.value)
+		if code, reply := postevent(t, sv, testjson, hdr); code != http.StatusForbidden || reply.Status != statusbadauth {
+			t.Errorf("Changed %s: got %d %s, expected 403 %s", change.field, code, reply.Status, statusbadauth)
+		}
+	}
+}
+
+func TestReplayBatch(t *testing.T) {
+	config := testconfig()
+	config.Auth.Legacy = false
+	sv := new(FastCGIServer)
+	if err := initserver(config, sv); err != nil {
+		t.Fatal(err)
+	}
+	body := testbatch(GenerateRandomTripid())
+	hdr := signcurrent(body, time.Now().Unix(), "3f6a8c1e-2b4d-4e7f-9a1c-5d8e2f3b4a77")
+	expected := [][]string{
+		{batchaccepted, batchaccepted, batchrejected},
+		{batchduplicate, batchduplicate, batchrejected}, // same signed batch again
+	}
+	for pass, statuses := range expected {
+		code, reply := postevent(t, sv, body, hdr)
+		if code != http.StatusOK || reply.Status != statusok || len(reply.Results) != len(statuses) {
+			t.Fatalf("Pass %d: got %d %s with %d results", pass, code, reply.Status, len(reply.Results))
+		}
+		for i, status := range statuses {
+			if reply.Results[i].Status != status {
+				t.Errorf("Pass %d, event %d: got %s, expected %s", pass, i, reply.Results[i].Status, status)
+			}
+		}
+	}
+	//  Same nonce, another batch
+	other := testbatch(GenerateRandomTripid())
+	hdr = signcurrent(other, time.Now().Unix(), "3f6a8c1e-2b4d-4e7f-9a1c-5d8e2f3b4a77")
+	if code, reply := postevent(t, sv, other, hdr); code != http.StatusForbidden || reply.Status != statusbadauth {
+		t.Errorf("Nonce used for another batch: got %d %s, expected 403 %s", code, reply.Status, statusbadauth)
+	}
+}
+
+func TestReplayBatchConflict(t *testing.T) {
+	config := testconfig()
+	config.Auth.Legacy = false
+	sv := new(FastCGIServer)
+	if err := initserver(config, sv); err != nil {
+		t.Fatal(err)
+	}
+	tripid := GenerateRandomTripid()
+	hdr, ev := testevent(tripid, 1) // a different event 1 is already stored
+	mustappend(t, sv.store, hdr, ev)
+	body := testbatch(tripid)
+	sighdr := signcurrent(body, time.Now().Unix(), "7c2d9e4a-1f3b-4a6c-8e5d-2b9f6a1c3e88")
+	expected := [][]string{
+		{batchaccepted, batchconflict, batchrejected},
+		{batchduplicate, batchconflict, batchrejected}, // same signed batch again, same conflict
+	}
+	for pass, statuses := range expected {
+		code, reply := postevent(t, sv, body, sighdr)
+		if code != http.StatusOK || reply.Status != statusok || len(reply.Results) != len(statuses) {
+			t.Fatalf("Pass %d: got %d %s with %d results", pass, code, reply.Status, len(reply.Results))
+		}
+		for i, status := range statuses {
+			if reply.Results[i].Status != status {
+				t.Errorf("Pass %d, event %d: got %s, expected %s", pass, i, reply.Results[i].Status, status)
+			}
+		}
+	}
+}
+
+func TestReplayLegacy(t *testing.T) {
+	sv := newtestserver(t) // legacy signatures allowed
+	testjson := []byte(strings.Replace(testjson1, "TRIPID", GenerateRandomTripid(), 1))
+	if code, reply := postevent(t, sv, testjson, signedheader(testjson)); code != http.StatusOK || reply.Status != statusok {
+		t.Errorf("Legacy signature: got %d %s", code, reply.Status)
+	}
+	testjson = []byte(strings.Replace(testjson1, "TRIPID", GenerateRandomTripid(), 1))
+	hdr := signcurrent(testjson, time.Now().Unix(), "9e4f1a3c-6d8b-4cae-bf5e-4b3a2d7c8e66")
+	if code, reply := postevent(t, sv, testjson, hdr); code != http.StatusOK || reply.Status != statusok {
+		t.Errorf("Current signature with legacy allowed: got %d %s", code, reply.Status)
+	}
+}
+
+//
+//  checknonces -- a nonce is stored with its events, once per key
+//
+func checknonces(t *testing.T, store vehstore) {
+	now := time.Unix(1521264571, 0)
+	n := usednonce{key_name: "TEST", nonce: "0e9ebf4b-0d3a-4b5a-9f4e-1b7e1f4a6c11", stamp: now}
+	tripid := GenerateRandomTripid()
+	hdr, ev := testevent(tripid, 0)
+	if err := store.appendevent(hdr, ev, n); err != nil {
+		t.Fatal(err)
+	}
+	hdr, ev = testevent(tripid, 1)
+	if err := store.appendevent(hdr, ev, n); err != errReplayedNonce {
+		t.Errorf("Nonce used again: got %v, expected %v", err, errReplayedNonce)
+	}
+	if _, err := store.loadevent(tripid, 1); err != errNoEvent {
+		t.Errorf("Event with replayed nonce stored: %v", err)
+	}
+	hdr, ev = testevent(tripid, 2)
+	if _, err := store.appendevents([]tripevent{{hdr: hdr, ev: ev}}, n); err != errReplayedNonce {
+		t.Errorf("Nonce used again in batch: got %v, expected %v", err, errReplayedNonce)
+	}
+	other := n
+	other.key_name = "OTHER"
+	if err := store.appendevent(hdr, ev, other); err != nil {
+		t.Errorf("Same nonce with another key: %v", err)
+	}
+	//  Duplicate event doesn't use up the nonce
+	fresh := usednonce{key_name: "TEST", nonce: "5b1f2c4e-7a33-4c1d-8e2f-0d9a6b3c7e21", stamp: now}
+	if err := store.appendevent(hdr, ev, fresh); err != errDuplicateEvent {
+		t.Fatalf("Duplicate event: got %v", err)
+	}
+	hdr, ev = testevent(tripid, 3)
+	if err := store.appendevent(hdr, ev, fresh); err != nil {
+		t.Errorf("Nonce of duplicate event: %v", err)
+	}
+	//  Pruned by signed time
+	if err := store.prunenonces(now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	hdr, ev = testevent(tripid, 4)
+	if err := store.appendevent(hdr, ev, n); err != nil {
+		t.Errorf("Nonce after prune: %v", err)
+	}
+}
+
+func TestNonces(t *testing.T) {
+	forstores(t, checknonces)
+}
+
+//
+//  countingprunestore -- counts nonce prunes
+//
+type countingprunestore struct {
+	*memstore
+	prunes int
+}
+
+func (s *countingprunestore) prunenonces(before time.Time) error {
+	s.prunes++
+	return s.memstore.prunenonces(before)
+}
+
+func TestNoncePruneBucket(t *testing.T) {
+	w := newnoncewindow(60)
+	store := &countingprunestore{memstore: newmemstore()}
+	now := time.Unix(1521264540, 0) // start of a bucket
+	for _, secs := range []int{0, 10, 59, 60, 61, 150} {
+		w.prune(store, now.Add(time.Duration(secs)*time.Second))
+	}
+	if store.prunes != 3 {
+		t.Errorf("Pruned %d times in 3 buckets, expected 3", store.prunes)
+	}
+}
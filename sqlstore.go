@@ -0,0 +1,1172 @@
+//
+//  sqlstore -- vehstore on an SQL database, MySQL or SQLite
+//
+//  The two dialects differ only in a few statements, kept in sqldialect.
+//
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/mattn/go-sqlite3"
+	"strings"
+	"time"
+)
+
+//
+//  Constants
+//
+const maxtxretries = 5                     // retries on deadlock before giving up
+const txretrydelay = 50 * time.Millisecond // first retry delay, doubled each retry
+const maxclaimtries = 10                   // trips to try claiming before giving up
+
+//
+//  txfailpoint -- test hook, called between the writes of a transaction.
+//  An error return aborts the transaction. Always nil in production.
+//
+var txfailpoint func(where string) error
+
+//
+//  dbexec -- executes statements. A *sql.DB or, inside a transaction, a *sql.Tx.
+//
+type dbexec interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+//
+//  sqldialect -- the statements which differ between databases
+//
+type sqldialect struct {
+	inserttodo  string // add to-do entry for trip ? with idle time ? and max trip time ?, or refresh it
+	upserttrip  string // end of insert of trip, updating an existing one; %s is the column list
+	newvalue    string // in upserttrip, the value being inserted for column %s
+	olderthan   string // in a WHERE, stamp is no later than time ?
+	oldesttodo  string // oldest unleased to-do entry for a trip which is over
+	claimtodo   string // lease to-do entry to worker ? for ? seconds, if not leased. Must not change stamp.
+	releasetodo string // end worker ?'s lease on to-do entry ?, restart max trip time. Must not change stamp.
+	leaseheld   string // count of to-do entries ? leased to worker ? and not expired, locked until commit
+	schema      string // tables to create at open, if any
+}
+
+var mysqldialect = sqldialect{
+	inserttodo:  "INSERT INTO tripstodo (tripid, idle_secs, max_secs) VALUES (?,?,?) ON DUPLICATE KEY UPDATE stamp=NOW()",
+	upserttrip:  "ON DUPLICATE KEY UPDATE %s, revision = revision + 1, recomputed = CURRENT_TIMESTAMP",
+	newvalue:    "VALUES(%s)",
+	olderthan:   "stamp <= ?",
+	oldesttodo:  "SELECT tripid, stamp FROM tripstodo WHERE (TIMESTAMPDIFF(SECOND, stamp, NOW()) > idle_secs OR (max_secs > 0 AND TIMESTAMPDIFF(SECOND, created, NOW()) > max_secs)) AND (lease_expires IS NULL OR lease_expires < NOW()) ORDER BY stamp LIMIT 1",
+	claimtodo:   "UPDATE tripstodo SET lease_owner = ?, lease_expires = NOW() + INTERVAL ? SECOND, stamp = stamp WHERE tripid = ? AND (lease_expires IS NULL OR lease_expires < NOW())",
+	releasetodo: "UPDATE tripstodo SET lease_owner = NULL, lease_expires = NULL, created = NOW(), stamp = stamp WHERE lease_owner = ? AND tripid = ?",
+	leaseheld:   "SELECT COUNT(*) FROM tripstodo WHERE tripid = ? AND lease_owner = ? AND lease_expires > NOW() FOR UPDATE",
+	schema:      "", // created from vehicledb.sql by the administrator
+}
+
+var sqlitedialect = sqldialect{
+	inserttodo:  "INSERT INTO tripstodo (tripid, idle_secs, max_secs) VALUES (?,?,?) ON CONFLICT(tripid) DO UPDATE SET stamp=CURRENT_TIMESTAMP",
+	upserttrip:  "ON CONFLICT(tripid) DO UPDATE SET %s, revision = revision + 1, recomputed = CURRENT_TIMESTAMP",
+	newvalue:    "excluded.%s",
+	olderthan:   "strftime('%s', stamp) <= strftime('%s', ?)", // stamp is text, compare as times
+	oldesttodo:  "SELECT tripid, stamp FROM tripstodo WHERE (strftime('%s','now') - strftime('%s', stamp) > idle_secs OR (max_secs > 0 AND strftime('%s','now') - strftime('%s', created) > max_secs)) AND (lease_expires IS NULL OR lease_expires < datetime('now')) ORDER BY stamp LIMIT 1",
+	claimtodo:   "UPDATE tripstodo SET lease_owner = ?, lease_expires = datetime('now', ? || ' seconds') WHERE tripid = ? AND (lease_expires IS NULL OR lease_expires < datetime('now'))",
+	releasetodo: "UPDATE tripstodo SET lease_owner = NULL, lease_expires = NULL, created = CURRENT_TIMESTAMP WHERE lease_owner = ? AND tripid = ?",
+	leaseheld:   "SELECT COUNT(*) FROM tripstodo WHERE tripid = ? AND lease_owner = ? AND lease_expires > datetime('now')", // the transaction holds the database
+	schema:      sqliteschema,
+}
+
+//
+//  sqliteschema -- SQLite version of vehicledb.sql
+//
+const sqliteschema = `
+CREATE TABLE IF NOT EXISTS events (
+	serial          INTEGER NOT NULL,
+	time            INTEGER NOT NULL,
+	shard           TEXT NOT NULL,
+	grid            TEXT NOT NULL DEFAULT '',
+	owner_name      TEXT NOT NULL,
+	owner_key       TEXT NOT NULL DEFAULT '',
+	object_name     TEXT NOT NULL,
+	object_key      TEXT NOT NULL DEFAULT '',
+	region_name     TEXT NOT NULL,
+	region_corner_x INTEGER NOT NULL,
+	region_corner_y INTEGER NOT NULL,
+	local_position_x REAL NOT NULL,
+	local_position_y REAL NOT NULL,
+	local_position_z REAL NOT NULL DEFAULT -1.0,
+	local_velocity_x REAL NOT NULL DEFAULT 0,
+	local_velocity_y REAL NOT NULL DEFAULT 0,
+	local_velocity_z REAL NOT NULL DEFAULT 0,
+	local_rotation_x REAL NOT NULL DEFAULT 0,
+	local_rotation_y REAL NOT NULL DEFAULT 0,
+	local_rotation_z REAL NOT NULL DEFAULT 0,
+	local_rotation_s REAL NOT NULL DEFAULT 0,
+	received        INTEGER NOT NULL DEFAULT 0,
+	suspect         INTEGER NOT NULL DEFAULT 0,
+	late            INTEGER NOT NULL DEFAULT 0,
+	tripid          TEXT NOT NULL,
+	severity        INTEGER NOT NULL,
+	eventtype       TEXT NOT NULL,
+	msg             TEXT,
+	auxval          REAL NOT NULL,
+	UNIQUE (tripid, serial)
+);
+CREATE INDEX IF NOT EXISTS events_eventtype ON events (eventtype);
+CREATE INDEX IF NOT EXISTS events_grid_region ON events (grid, region_name);
+CREATE TABLE IF NOT EXISTS errorlog (
+	stamp           TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	owner_name      TEXT DEFAULT NULL,
+	tripid          TEXT DEFAULT NULL,
+	category        TEXT DEFAULT NULL,
+	msg             TEXT
+);
+CREATE INDEX IF NOT EXISTS errorlog_owner_name ON errorlog (owner_name);
+CREATE INDEX IF NOT EXISTS errorlog_tripid ON errorlog (tripid);
+CREATE INDEX IF NOT EXISTS errorlog_stamp ON errorlog (stamp);
+CREATE TABLE IF NOT EXISTS nonces (
+	key_name        TEXT NOT NULL,
+	nonce           TEXT NOT NULL,
+	stamp           INTEGER NOT NULL,
+	UNIQUE (key_name, nonce)
+);
+CREATE INDEX IF NOT EXISTS nonces_stamp ON nonces (stamp);
+CREATE TABLE IF NOT EXISTS tripstodo (
+	tripid          TEXT NOT NULL PRIMARY KEY,
+	stamp           TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	created         TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	idle_secs       INTEGER NOT NULL DEFAULT 120,
+	max_secs        INTEGER NOT NULL DEFAULT 0,
+	lease_owner     TEXT DEFAULT NULL,
+	lease_expires   TIMESTAMP DEFAULT NULL
+);
+CREATE TABLE IF NOT EXISTS trips (
+	stamp           TIMESTAMP NOT NULL,
+	elapsed         INTEGER NOT NULL,
+	tripid          TEXT NOT NULL UNIQUE,
+	owner_name      TEXT NOT NULL,
+	owner_key       TEXT NOT NULL DEFAULT '',
+	shard           TEXT NOT NULL,
+	grid            TEXT NOT NULL DEFAULT '',
+	object_name     TEXT NOT NULL,
+	object_key      TEXT NOT NULL DEFAULT '',
+	driver_key      TEXT NOT NULL,
+	driver_name     TEXT NOT NULL,
+	driver_display_name TEXT NOT NULL,
+	distance        REAL NOT NULL,
+	regions_crossed INTEGER NOT NULL,
+	trip_status     TEXT CHECK (trip_status IN ('OK','FAULT','NOSHUTDOWN')),
+	ended_shutdown  INTEGER NOT NULL DEFAULT 0,
+	data_status     TEXT CHECK (data_status IN ('OK','MISSING','INCONSISTENT')),
+	severity        INTEGER NOT NULL,
+	start_region_name TEXT NOT NULL,
+	end_region_name TEXT NOT NULL,
+	min_pos_x       REAL NOT NULL,
+	min_pos_y       REAL NOT NULL,
+	max_pos_x       REAL NOT NULL,
+	max_pos_y       REAL NOT NULL,
+	min_pos_z       REAL NOT NULL DEFAULT -1.0,
+	max_pos_z       REAL NOT NULL DEFAULT -1.0,
+	last_eventtypes TEXT,
+	msg             TEXT,
+	clock_skew      INTEGER NOT NULL DEFAULT 0,
+	suspect_events  INTEGER NOT NULL DEFAULT 0,
+	late_events     INTEGER NOT NULL DEFAULT 0,
+	max_speed       REAL NOT NULL DEFAULT 0,
+	avg_speed       REAL NOT NULL DEFAULT 0,
+	heading_change  REAL NOT NULL DEFAULT 0,
+	flips           INTEGER NOT NULL DEFAULT 0,
+	spins           INTEGER NOT NULL DEFAULT 0,
+	revision        INTEGER NOT NULL DEFAULT 1,
+	recomputed      TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS trips_driver_name ON trips (driver_name);
+CREATE INDEX IF NOT EXISTS trips_trip_status ON trips (trip_status);
+CREATE INDEX IF NOT EXISTS trips_driver_key ON trips (driver_key);
+CREATE INDEX IF NOT EXISTS trips_grid ON trips (grid);
+CREATE INDEX IF NOT EXISTS trips_owner_key ON trips (owner_key);
+CREATE INDEX IF NOT EXISTS trips_object_key ON trips (object_key);
+CREATE TABLE IF NOT EXISTS tripsegments (
+	tripid          TEXT NOT NULL,
+	seq             INTEGER NOT NULL,
+	region_name     TEXT NOT NULL,
+	entered         INTEGER NOT NULL,
+	exited          INTEGER NOT NULL,
+	entry_pos_x     REAL NOT NULL,
+	entry_pos_y     REAL NOT NULL,
+	exit_pos_x      REAL NOT NULL,
+	exit_pos_y      REAL NOT NULL,
+	entry_pos_z     REAL NOT NULL DEFAULT -1.0,
+	exit_pos_z      REAL NOT NULL DEFAULT -1.0,
+	distance        REAL NOT NULL,
+	events          INTEGER NOT NULL,
+	faults          INTEGER NOT NULL,
+	PRIMARY KEY (tripid, seq)
+);
+CREATE INDEX IF NOT EXISTS tripsegments_region_name ON tripsegments (region_name);
+CREATE TABLE IF NOT EXISTS crossings (
+	tripid          TEXT NOT NULL,
+	seq             INTEGER NOT NULL,
+	grid            TEXT NOT NULL,
+	region_a_name   TEXT NOT NULL,
+	region_a_x      INTEGER NOT NULL,
+	region_a_y      INTEGER NOT NULL,
+	region_b_name   TEXT NOT NULL,
+	region_b_x      INTEGER NOT NULL,
+	region_b_y      INTEGER NOT NULL,
+	stamp           INTEGER NOT NULL,
+	speed           REAL NOT NULL,
+	duration        REAL NOT NULL,
+	pos_error       REAL NOT NULL,
+	complete        INTEGER NOT NULL,
+	PRIMARY KEY (tripid, seq)
+);
+CREATE INDEX IF NOT EXISTS crossings_boundary ON crossings (grid, region_a_x, region_a_y, region_b_x, region_b_y);
+CREATE TABLE IF NOT EXISTS falls (
+	tripid          TEXT NOT NULL,
+	seq             INTEGER NOT NULL,
+	grid            TEXT NOT NULL,
+	region_name     TEXT NOT NULL,
+	serial          INTEGER NOT NULL,
+	stamp           INTEGER NOT NULL,
+	kind            TEXT CHECK (kind IN ('DROP','JUMP')),
+	from_z          REAL NOT NULL,
+	to_z            REAL NOT NULL,
+	pos_x           REAL NOT NULL,
+	pos_y           REAL NOT NULL,
+	near_crossing   INTEGER NOT NULL,
+	PRIMARY KEY (tripid, seq)
+);
+CREATE INDEX IF NOT EXISTS falls_grid_region ON falls (grid, region_name);
+`
+
+//
+//  sqlstore -- an SQL database and its dialect
+//
+type sqlstore struct {
+	db      *sql.DB    // database
+	dialect sqldialect // statements for this database
+}
+
+//
+//  openmysqlstore -- open the MySQL database named in the config
+//
+func openmysqlstore(config vdbconfig) (*sqlstore, error) {
+	const mysqloptions = "parseTime=true" // makes TIMESTAMP -> time.Time conversions work
+	//  Set database parameters (does not actually do an open in Go, so it won't fail)
+	s := fmt.Sprintf("%s:%s@tcp(%s)/%s?%s",
+		config.Mysql.User, config.Mysql.Password, config.Mysql.Domain, config.Mysql.Database, mysqloptions)
+	db, err := sql.Open("mysql", s)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlstore{db: db, dialect: mysqldialect}, nil
+}
+
+//
+//  opensqlitestore -- open or create an SQLite database file
+//
+func opensqlitestore(path string) (*sqlstore, error) {
+	if path == "" {
+		return nil, errors.New("No SQLite database file in config")
+	}
+	path, err := expand(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(sqlitedialect.schema) // create tables if needed
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlstore{db: db, dialect: sqlitedialect}, nil
+}
+
+func (s *sqlstore) close() error {
+	return s.db.Close()
+}
+
+//
+//  insertevent -- insert an event, marked late if its trip had ended
+//
+//  Only a trip which ended with SHUTDOWN has ended. An event for any other
+//  summarized trip, with or without faults, isn't late. The trip was only
+//  paused for longer than the idle time, or ran past the maximum trip
+//  time, and it reopens.
+//
+func insertevent(db dbexec, hdr slheader, ev vehlogevent) error {
+	const insstmt string = "INSERT INTO events  (time, received, suspect, shard, grid, owner_name, owner_key, object_name, object_key, region_name, region_corner_x, region_corner_y, local_position_x, local_position_y, local_position_z, local_velocity_x, local_velocity_y, local_velocity_z, local_rotation_x, local_rotation_y, local_rotation_z, local_rotation_s, tripid, severity, eventtype, msg, auxval, serial, late)  VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,(SELECT COUNT(*) FROM trips WHERE tripid = ? AND ended_shutdown) > 0)"
+	_, err := db.Exec(insstmt,
+		ev.Timestamp,
+		ev.Received,
+		ev.Suspect,
+		hdr.Shard,
+		hdr.Grid,
+		hdr.Owner_name,
+		hdr.Owner_key,
+		hdr.Object_name,
+		hdr.Object_key,
+		hdr.Region.Name,
+		hdr.Region.X,
+		hdr.Region.Y,
+		hdr.Local_position.X,
+		hdr.Local_position.Y,
+		hdr.Local_position.Z,
+		hdr.Local_velocity.X,
+		hdr.Local_velocity.Y,
+		hdr.Local_velocity.Z,
+		hdr.Local_rotation.X,
+		hdr.Local_rotation.Y,
+		hdr.Local_rotation.Z,
+		hdr.Local_rotation.S,
+		ev.Tripid,
+		ev.Severity,
+		ev.Eventtype,
+		ev.Msg,
+		ev.Auxval,
+		ev.Serial,
+		ev.Tripid)
+	return err
+}
+
+//
+//  inserttodo -- update to-do list of trips in progress
+//
+//  A new entry gets the trip end rules for the object.
+//
+func (s *sqlstore) inserttodo(db dbexec, tripid string, object_name string) error {
+	idlesecs, maxsecs := tripend.forobject(object_name)
+	_, err := db.Exec(s.dialect.inserttodo, tripid, idlesecs, maxsecs)
+	return err
+}
+
+//
+//  isretryable -- true if transaction failed from contention, and may succeed if run again
+//
+func isretryable(err error) bool {
+	switch e := err.(type) {
+	case *mysql.MySQLError:
+		return e.Number == 1213 || e.Number == 1205 // deadlock, lock wait timeout
+	case sqlite3.Error:
+		return e.Code == sqlite3.ErrBusy || e.Code == sqlite3.ErrLocked
+	}
+	return false
+}
+
+//
+//  isduplicate -- true if insert failed on a unique index
+//
+func isduplicate(err error) bool {
+	switch e := err.(type) {
+	case *mysql.MySQLError:
+		return e.Number == 1062 // duplicate entry for key
+	case sqlite3.Error:
+		return e.ExtendedCode == sqlite3.ErrConstraintUnique || e.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+	return false
+}
+
+//
+//  withtx -- run fn inside a transaction, commit if it succeeds, roll back if not
+//
+//  Retries on deadlock and similar contention errors.
+//
+func withtx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	delay := txretrydelay
+	for i := 0; ; i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		err = fn(tx)
+		if err == nil {
+			err = tx.Commit() // all OK, commit
+			if err == nil {
+				return nil // success
+			}
+		} else {
+			_ = tx.Rollback() // fail, undo
+		}
+		if !isretryable(err) || i >= maxtxretries {
+			return err
+		}
+		time.Sleep(delay) // let the other transaction finish
+		delay *= 2
+	}
+}
+
+//
+//  dbupdate -- do the database updates to insert an event
+//
+func (s *sqlstore) dbupdate(tx dbexec, hdr slheader, ev vehlogevent) error {
+	err := insertevent(tx, hdr, ev)
+	if err == nil && txfailpoint != nil {
+		err = txfailpoint("dbupdate")
+	}
+	if err == nil {
+		err = s.inserttodo(tx, ev.Tripid, hdr.Object_name)
+	}
+	return err
+}
+
+//
+//  insertnonce -- record the nonce of a signed message, or errReplayedNonce if already used
+//
+func insertnonce(tx dbexec, n usednonce) error {
+	if n.nonce == "" { // legacy message
+		return nil
+	}
+	_, err := tx.Exec("INSERT INTO nonces (key_name, nonce, stamp) VALUES (?, ?, ?)", n.key_name, n.nonce, n.stamp.Unix())
+	if isduplicate(err) {
+		return errReplayedNonce
+	}
+	return err
+}
+
+func (s *sqlstore) appendevent(hdr slheader, ev vehlogevent, n usednonce) error {
+	err := withtx(s.db, func(tx *sql.Tx) error { // updating nonces, events, and tripstodo
+		err := insertnonce(tx, n)
+		if err == nil {
+			err = s.dbupdate(tx, hdr, ev)
+		}
+		return err
+	})
+	if isduplicate(err) {
+		return errDuplicateEvent
+	}
+	return dbfail(err)
+}
+
+//
+//  appendevents -- insert a batch of events in one transaction
+//
+//  A duplicate event doesn't stop the others; it gets errDuplicateEvent
+//  in the per-event results. Any other error undoes the whole batch.
+//
+func (s *sqlstore) appendevents(events []tripevent, n usednonce) ([]error, error) {
+	var results []error
+	err := withtx(s.db, func(tx *sql.Tx) error {
+		if err := insertnonce(tx, n); err != nil {
+			return err
+		}
+		results = make([]error, len(events)) // fresh on each retry
+		var tripids []string                 // trips to put on to-do list
+		var objects []string                 // and their objects
+		for i, te := range events {
+			err := insertevent(tx, te.hdr, te.ev)
+			if isduplicate(err) {
+				results[i] = errDuplicateEvent
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if len(tripids) == 0 || tripids[len(tripids)-1] != te.ev.Tripid {
+				tripids = append(tripids, te.ev.Tripid)
+				objects = append(objects, te.hdr.Object_name)
+			}
+		}
+		for i, tripid := range tripids {
+			if err := s.inserttodo(tx, tripid, objects[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return results, dbfail(err)
+}
+
+//
+//  prunenonces -- delete nonces of messages signed before this, too old to accept
+//
+func (s *sqlstore) prunenonces(before time.Time) error {
+	_, err := s.db.Exec("DELETE FROM nonces WHERE stamp < ?", before.Unix())
+	return dbfail(err)
+}
+
+func (s *sqlstore) marktrippending(tripid string) error {
+	return dbfail(s.inserttodo(s.db, tripid, ""))
+}
+
+//
+//  pendingtrip -- get earliest tripid of a trip which is over
+//
+func (s *sqlstore) pendingtrip() (string, time.Time, error) {
+	row := s.db.QueryRow(s.dialect.oldesttodo)
+	var tripid string // trip ID to be processed
+	var stamp time.Time
+	err := row.Scan(&tripid, &stamp)
+	if err == sql.ErrNoRows {
+		return tripid, stamp, errNoPendingTrip // normal EOF
+	}
+	return tripid, stamp, dbfail(err)
+}
+
+//
+//  claimtrip -- lease the earliest pending trip to a worker
+//
+//  Another worker may claim the same trip between the select and the
+//  update. The update only succeeds for one of them; the loser tries the
+//  next trip. A lease not released by writetripsummary expires, so a
+//  crashed worker's trip is picked up later.
+//
+func (s *sqlstore) claimtrip(worker string, leasesecs int) (string, time.Time, error) {
+	for i := 0; i < maxclaimtries; i++ {
+		tripid, stamp, err := s.pendingtrip()
+		if err != nil {
+			return tripid, stamp, err
+		}
+		res, err := s.db.Exec(s.dialect.claimtodo, worker, leasesecs, tripid)
+		if err != nil {
+			return tripid, stamp, dbfail(err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return tripid, stamp, dbfail(err)
+		}
+		if n == 1 {
+			return tripid, stamp, nil // ours
+		}
+	}
+	return "", time.Time{}, errNoPendingTrip // heavy contention, try next cycle
+}
+
+//
+//  Reading events back
+//
+const eventcolumns = "tripid, time, received, suspect, late, shard, grid, owner_name, owner_key, object_name, object_key, region_name, region_corner_x, region_corner_y, local_position_x, local_position_y, local_position_z, local_velocity_x, local_velocity_y, local_velocity_z, local_rotation_x, local_rotation_y, local_rotation_z, local_rotation_s, severity, eventtype, msg, auxval, serial"
+
+type rowscanner interface {
+	Scan(dest ...interface{}) error
+}
+
+//
+//  scanevent -- get event from a row of eventcolumns
+//
+func scanevent(row rowscanner) (tripevent, error) {
+	var te tripevent
+	event := &te.ev
+	hdr := &te.hdr
+	err := row.Scan(&event.Tripid, &event.Timestamp, &event.Received, &event.Suspect, &event.Late, &hdr.Shard, &hdr.Grid, &hdr.Owner_name, &hdr.Owner_key, &hdr.Object_name, &hdr.Object_key, &hdr.Region.Name, &hdr.Region.X, &hdr.Region.Y,
+		&hdr.Local_position.X, &hdr.Local_position.Y, &hdr.Local_position.Z,
+		&hdr.Local_velocity.X, &hdr.Local_velocity.Y, &hdr.Local_velocity.Z,
+		&hdr.Local_rotation.X, &hdr.Local_rotation.Y, &hdr.Local_rotation.Z, &hdr.Local_rotation.S,
+		&event.Severity, &event.Eventtype, &event.Msg, &event.Auxval, &event.Serial)
+	return te, err
+}
+
+//
+//  tripevents -- read events for this trip in serial order
+//
+func (s *sqlstore) tripevents(tripid string) ([]tripevent, error) {
+	rows, err := s.db.Query("SELECT "+eventcolumns+" FROM events WHERE tripid = ? ORDER BY serial", tripid)
+	if err != nil {
+		return nil, dbfail(err)
+	}
+	defer rows.Close()
+	var events []tripevent
+	for rows.Next() { // over all rows
+		te, err := scanevent(rows)
+		if err != nil {
+			return nil, dbfail(err)
+		}
+		events = append(events, te)
+	}
+	return events, dbfail(rows.Err())
+}
+
+//
+//  loadevent -- read one stored event
+//
+func (s *sqlstore) loadevent(tripid string, serial int32) (tripevent, error) {
+	te, err := scanevent(s.db.QueryRow("SELECT "+eventcolumns+" FROM events WHERE tripid = ? AND serial = ?", tripid, serial))
+	if err == sql.ErrNoRows {
+		return te, errNoEvent
+	}
+	return te, dbfail(err)
+}
+
+//
+//  logerror -- add entry to errorlog table
+//
+func (s *sqlstore) logerror(e errorlogentry) error {
+	_, err := s.db.Exec("INSERT INTO errorlog (stamp, owner_name, tripid, category, msg) VALUES (CURRENT_TIMESTAMP,?,?,?,?)",
+		nullable(e.owner_name), nullable(e.tripid), e.category, e.msg)
+	return dbfail(err)
+}
+
+//
+//  recenterrors -- most recent errorlog entries, newest first
+//
+//  Selects by owner and trip ID if not empty.
+//
+func (s *sqlstore) recenterrors(owner_name string, tripid string, limit int) ([]errorlogentry, error) {
+	query := "SELECT stamp, owner_name, tripid, category, msg FROM errorlog WHERE 1=1"
+	var args []interface{}
+	if owner_name != "" {
+		query += " AND owner_name = ?"
+		args = append(args, owner_name)
+	}
+	if tripid != "" {
+		query += " AND tripid = ?"
+		args = append(args, tripid)
+	}
+	query += " ORDER BY stamp DESC LIMIT ?"
+	args = append(args, limit)
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, dbfail(err)
+	}
+	defer rows.Close()
+	var entries []errorlogentry
+	for rows.Next() {
+		var e errorlogentry
+		var owner, trip, category, msg sql.NullString // older rows may have NULLs
+		err = rows.Scan(&e.stamp, &owner, &trip, &category, &msg)
+		if err != nil {
+			return nil, dbfail(err)
+		}
+		e.owner_name, e.tripid, e.category, e.msg = owner.String, trip.String, category.String, msg.String
+		entries = append(entries, e)
+	}
+	return entries, dbfail(rows.Err())
+}
+
+//
+//  nullable -- empty string as SQL NULL
+//
+func nullable(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+//
+//  Trip columns, in the order inserttrip and loadtripsummary use them.
+//  The store maintains storedtripcolumns.
+//
+const tripcolumns = "stamp, elapsed, tripid, owner_name, owner_key, shard, grid, object_name, object_key, driver_key, driver_name, driver_display_name, distance, regions_crossed, trip_status, ended_shutdown, data_status, severity, start_region_name, end_region_name, min_pos_x, min_pos_y, min_pos_z, max_pos_x, max_pos_y, max_pos_z, last_eventtypes, msg, clock_skew, suspect_events, late_events, max_speed, avg_speed, heading_change, flips, spins"
+const storedtripcolumns = "revision, recomputed"
+
+//
+//  placeholders -- "?,?,?" for n values
+//
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+//
+//  inserttrip -- insert trip info in database
+//
+//  A trip already there is replaced, and its revision counted up. This
+//  happens when events arrive after the trip was summarized.
+//
+func (s *sqlstore) inserttrip(db dbexec, r tripsummary) error {
+	var updates []string
+	for _, col := range strings.Split(tripcolumns, ", ") {
+		if col != "tripid" {
+			updates = append(updates, col+" = "+fmt.Sprintf(s.dialect.newvalue, col))
+		}
+	}
+	insstmt := "INSERT INTO trips (" + tripcolumns + ") VALUES (" + placeholders(strings.Count(tripcolumns, ",")+1) + ") " +
+		fmt.Sprintf(s.dialect.upserttrip, strings.Join(updates, ", "))
+	//   Convert last eventtypes into TYPE-TYPE-TYPE for SQL
+	_, err := db.Exec(insstmt,
+		r.stamp,
+		r.elapsed,
+		r.tripid,
+		r.owner_name,
+		r.owner_key,
+		r.shard,
+		r.grid,
+		r.object_name,
+		r.object_key,
+		r.driver_key,
+		r.driver_name,
+		r.driver_display_name,
+		r.distance,
+		r.regions_crossed,
+		r.trip_status,
+		r.ended_shutdown,
+		r.data_status,
+		r.severity,
+		r.start_region_name,
+		r.end_region_name,
+		r.min_pos.X,
+		r.min_pos.Y,
+		r.min_pos.Z,
+		r.max_pos.X,
+		r.max_pos.Y,
+		r.max_pos.Z,
+		strings.Join(r.last_eventtypes, ", "),
+		r.msg,
+		r.clock_skew,
+		r.suspect_events,
+		r.late_events,
+		r.max_speed,
+		r.avg_speed,
+		r.heading_change,
+		r.flips,
+		r.spins)
+	return err
+}
+
+//
+//  Segment columns, in the order insertsegments and tripsegments use them
+//
+const segmentcolumns = "tripid, seq, region_name, entered, exited, entry_pos_x, entry_pos_y, entry_pos_z, exit_pos_x, exit_pos_y, exit_pos_z, distance, events, faults"
+
+//
+//  insertsegments -- replace the segments of a trip
+//
+func insertsegments(db dbexec, r tripsummary) error {
+	_, err := db.Exec("DELETE FROM tripsegments WHERE tripid = ?", r.tripid) // from an earlier revision
+	if err != nil {
+		return err
+	}
+	insstmt := "INSERT INTO tripsegments (" + segmentcolumns + ") VALUES (" + placeholders(strings.Count(segmentcolumns, ",")+1) + ")"
+	for _, seg := range r.segments {
+		_, err = db.Exec(insstmt, r.tripid, seg.seq, seg.region_name, seg.entered, seg.exited,
+			seg.entry_pos.X, seg.entry_pos.Y, seg.entry_pos.Z, seg.exit_pos.X, seg.exit_pos.Y, seg.exit_pos.Z,
+			seg.distance, seg.events, seg.faults)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+//  Crossing columns, in the order insertcrossings and tripcrossings use them
+//
+const crossingcolumns = "tripid, seq, grid, region_a_name, region_a_x, region_a_y, region_b_name, region_b_x, region_b_y, stamp, speed, duration, pos_error, complete"
+
+//
+//  insertcrossings -- replace the crossings of a trip
+//
+func insertcrossings(db dbexec, r tripsummary) error {
+	_, err := db.Exec("DELETE FROM crossings WHERE tripid = ?", r.tripid) // from an earlier revision
+	if err != nil {
+		return err
+	}
+	insstmt := "INSERT INTO crossings (" + crossingcolumns + ") VALUES (" + placeholders(strings.Count(crossingcolumns, ",")+1) + ")"
+	for _, c := range r.crossings {
+		_, err = db.Exec(insstmt, r.tripid, c.seq, c.grid,
+			c.region_a.Name, c.region_a.X, c.region_a.Y, c.region_b.Name, c.region_b.X, c.region_b.Y,
+			c.stamp, c.speed, c.duration, c.pos_error, c.complete)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+//  Fall columns, in the order insertfalls and scanfalls use them
+//
+const fallcolumns = "tripid, seq, grid, region_name, serial, stamp, kind, from_z, to_z, pos_x, pos_y, near_crossing"
+
+//
+//  insertfalls -- replace the falls of a trip
+//
+func insertfalls(db dbexec, r tripsummary) error {
+	_, err := db.Exec("DELETE FROM falls WHERE tripid = ?", r.tripid) // from an earlier revision
+	if err != nil {
+		return err
+	}
+	insstmt := "INSERT INTO falls (" + fallcolumns + ") VALUES (" + placeholders(strings.Count(fallcolumns, ",")+1) + ")"
+	for _, f := range r.falls {
+		_, err = db.Exec(insstmt, r.tripid, f.seq, f.grid, f.region_name, f.serial, f.stamp, f.kind,
+			f.from_z, f.to_z, f.pos.X, f.pos.Y, f.near_crossing)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+//  deletetodo  -- delete to-do entry from to-do list
+//
+//  Only if worker holds the lease; a worker whose lease expired and was
+//  taken over leaves the entry to the new worker. Not if an event arrived
+//  after stamp, the to-do time when the trip was picked up. Then the trip
+//  has to be summarized again, and the lease is ended so that can happen
+//  once the trip is idle.
+//
+func (s *sqlstore) deletetodo(db dbexec, worker string, tripid string, stamp time.Time) error {
+	if tripid == "" {
+		return (errors.New("deletetodo: empty tripid"))
+	}
+	_, err := db.Exec("DELETE FROM tripstodo WHERE lease_owner = ? AND tripid = ? AND "+s.dialect.olderthan, worker, tripid, stamp)
+	if err == nil {
+		_, err = db.Exec(s.dialect.releasetodo, worker, tripid) // if still there
+	}
+	return (err)
+}
+
+//
+//  droptodo -- take a trip with no events off the to-do list
+//
+func (s *sqlstore) droptodo(worker string, tripid string, stamp time.Time) error {
+	return dbfail(s.deletetodo(s.db, worker, tripid, stamp))
+}
+
+//
+//  updatetripdb  -- update trip database from trip record
+//
+//  Also replaces the trip's segments, crossings, and falls, and deletes
+//  corresponding record from tripstodo. Only if worker still holds its
+//  lease; otherwise nothing is written and the result is errLeaseLost.
+//  The summary may be stale, and the worker which took over the trip
+//  writes it.
+//
+func (s *sqlstore) updatetripdb(tx dbexec, worker string, r tripsummary) error {
+	var held int
+	if err := tx.QueryRow(s.dialect.leaseheld, r.tripid, worker).Scan(&held); err != nil {
+		return err
+	}
+	if held == 0 {
+		return errLeaseLost
+	}
+	err := s.replacetriprows(tx, r)
+	if err == nil {
+		err = s.deletetodo(tx, worker, r.tripid, r.stamp)
+	}
+	return err
+}
+
+//
+//  replacetriprows -- store trip, segments, crossings, and falls
+//
+//  Duplicate tripid - replace, as a new revision
+//
+func (s *sqlstore) replacetriprows(tx dbexec, r tripsummary) error {
+	err := s.inserttrip(tx, r)
+	if err == nil {
+		err = insertsegments(tx, r)
+	}
+	if err == nil {
+		err = insertcrossings(tx, r)
+	}
+	if err == nil {
+		err = insertfalls(tx, r)
+	}
+	if err == nil && txfailpoint != nil {
+		err = txfailpoint("updatetripdb")
+	}
+	return err
+}
+
+func (s *sqlstore) writetripsummary(worker string, r tripsummary) error {
+	return dbfail(withtx(s.db, func(tx *sql.Tx) error { // updating trips and tripstodo
+		return s.updatetripdb(tx, worker, r)
+	}))
+}
+
+//
+//  rebuildtripsummary -- store a recomputed summary, leaving tripstodo alone
+//
+//  A summarizer may be working on the same trip; its lease stays with it.
+//
+func (s *sqlstore) rebuildtripsummary(r tripsummary) error {
+	return dbfail(withtx(s.db, func(tx *sql.Tx) error {
+		return s.replacetriprows(tx, r)
+	}))
+}
+
+//
+//  scantripsummary -- get trip summary from a row of tripcolumns, then storedtripcolumns
+//
+func scantripsummary(row rowscanner) (tripsummary, error) {
+	var r tripsummary
+	var lasteventtypes string
+	err := row.Scan(&r.stamp, &r.elapsed, &r.tripid, &r.owner_name, &r.owner_key, &r.shard, &r.grid, &r.object_name, &r.object_key,
+		&r.driver_key, &r.driver_name, &r.driver_display_name, &r.distance, &r.regions_crossed,
+		&r.trip_status, &r.ended_shutdown, &r.data_status, &r.severity, &r.start_region_name, &r.end_region_name,
+		&r.min_pos.X, &r.min_pos.Y, &r.min_pos.Z, &r.max_pos.X, &r.max_pos.Y, &r.max_pos.Z, &lasteventtypes, &r.msg,
+		&r.clock_skew, &r.suspect_events, &r.late_events, &r.max_speed, &r.avg_speed, &r.heading_change,
+		&r.flips, &r.spins, &r.revision, &r.recomputed)
+	if lasteventtypes != "" {
+		r.last_eventtypes = strings.Split(lasteventtypes, ", ")
+	}
+	return r, err
+}
+
+//
+//  loadtripsummary -- read back a trip summary
+//
+func (s *sqlstore) loadtripsummary(tripid string) (tripsummary, error) {
+	r, err := scantripsummary(s.db.QueryRow("SELECT "+tripcolumns+", "+storedtripcolumns+" FROM trips WHERE tripid = ?", tripid))
+	if err == sql.ErrNoRows {
+		return r, errNoTrip
+	}
+	return r, dbfail(err)
+}
+
+//
+//  tripsegments -- read back the segments of a trip
+//
+func (s *sqlstore) tripsegments(tripid string) ([]tripsegment, error) {
+	rows, err := s.db.Query("SELECT "+segmentcolumns+" FROM tripsegments WHERE tripid = ? ORDER BY seq", tripid)
+	if err != nil {
+		return nil, dbfail(err)
+	}
+	defer rows.Close()
+	var segments []tripsegment
+	for rows.Next() {
+		var seg tripsegment
+		err = rows.Scan(&seg.tripid, &seg.seq, &seg.region_name, &seg.entered, &seg.exited,
+			&seg.entry_pos.X, &seg.entry_pos.Y, &seg.entry_pos.Z, &seg.exit_pos.X, &seg.exit_pos.Y, &seg.exit_pos.Z,
+			&seg.distance, &seg.events, &seg.faults)
+		if err != nil {
+			return nil, dbfail(err)
+		}
+		segments = append(segments, seg)
+	}
+	return segments, dbfail(rows.Err())
+}
+
+//
+//  tripcrossings -- read back the crossings of a trip
+//
+func (s *sqlstore) tripcrossings(tripid string) ([]crossing, error) {
+	rows, err := s.db.Query("SELECT "+crossingcolumns+" FROM crossings WHERE tripid = ? ORDER BY seq", tripid)
+	if err != nil {
+		return nil, dbfail(err)
+	}
+	defer rows.Close()
+	var crossings []crossing
+	for rows.Next() {
+		var c crossing
+		err = rows.Scan(&c.tripid, &c.seq, &c.grid,
+			&c.region_a.Name, &c.region_a.X, &c.region_a.Y, &c.region_b.Name, &c.region_b.X, &c.region_b.Y,
+			&c.stamp, &c.speed, &c.duration, &c.pos_error, &c.complete)
+		if err != nil {
+			return nil, dbfail(err)
+		}
+		crossings = append(crossings, c)
+	}
+	return crossings, dbfail(rows.Err())
+}
+
+//
+//  scanfalls -- falls from rows of fallcolumns
+//
+func scanfalls(rows *sql.Rows, err error) ([]fall, error) {
+	if err != nil {
+		return nil, dbfail(err)
+	}
+	defer rows.Close()
+	var falls []fall
+	for rows.Next() {
+		var f fall
+		err = rows.Scan(&f.tripid, &f.seq, &f.grid, &f.region_name, &f.serial, &f.stamp, &f.kind,
+			&f.from_z, &f.to_z, &f.pos.X, &f.pos.Y, &f.near_crossing)
+		if err != nil {
+			return nil, dbfail(err)
+		}
+		f.pos.Z = f.to_z
+		falls = append(falls, f)
+	}
+	return falls, dbfail(rows.Err())
+}
+
+//
+//  tripfalls -- read back the falls of a trip
+//
+func (s *sqlstore) tripfalls(tripid string) ([]fall, error) {
+	return scanfalls(s.db.Query("SELECT "+fallcolumns+" FROM falls WHERE tripid = ? ORDER BY seq", tripid))
+}
+
+//
+//  findfalls -- falls on a grid, or in a region of it, newest first
+//
+func (s *sqlstore) findfalls(grid string, region_name string, limit int) ([]fall, error) {
+	query := "SELECT " + fallcolumns + " FROM falls WHERE 1=1"
+	var args []interface{}
+	if grid != "" {
+		query += " AND grid = ?"
+		args = append(args, grid)
+	}
+	if region_name != "" {
+		query += " AND region_name = ?"
+		args = append(args, region_name)
+	}
+	query += " ORDER BY stamp DESC, tripid, seq"
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+	return scanfalls(s.db.Query(query, args...))
+}
+
+//
+//  findtrips -- trip summaries selected by filter, newest first
+//
+func (s *sqlstore) findtrips(f tripfilter) ([]tripsummary, error) {
+	query := "SELECT " + tripcolumns + ", " + storedtripcolumns + " FROM trips WHERE 1=1"
+	var args []interface{}
+	if f.grid != "" {
+		query += " AND grid = ?"
+		args = append(args, f.grid)
+	}
+	if f.owner_name != "" {
+		query += " AND owner_name = ?"
+		args = append(args, f.owner_name)
+	}
+	if f.owner_key != "" {
+		query += " AND owner_key = ?"
+		args = append(args, f.owner_key)
+	}
+	if f.object_name != "" {
+		query += " AND object_name = ?"
+		args = append(args, f.object_name)
+	}
+	if f.object_key != "" {
+		query += " AND object_key = ?"
+		args = append(args, f.object_key)
+	}
+	if !f.since.IsZero() {
+		query += " AND stamp >= ?"
+		args = append(args, f.since.UTC()) // stamps are stored in UTC
+	}
+	if !f.until.IsZero() {
+		query += " AND stamp < ?"
+		args = append(args, f.until.UTC())
+	}
+	if f.trip_status != "" {
+		query += " AND trip_status = ?"
+		args = append(args, f.trip_status)
+	}
+	if f.region_name != "" { // region names are only unique within a grid
+		query += " AND tripid IN (SELECT tripid FROM events WHERE region_name = ?"
+		args = append(args, f.region_name)
+		if f.grid != "" {
+			query += " AND grid = ?"
+			args = append(args, f.grid)
+		}
+		query += ")"
+	}
+	query += " ORDER BY stamp DESC"
+	if f.limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, f.limit)
+	}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, dbfail(err)
+	}
+	defer rows.Close()
+	var trips []tripsummary
+	for rows.Next() {
+		r, err := scantripsummary(rows)
+		if err != nil {
+			return nil, dbfail(err)
+		}
+		trips = append(trips, r)
+	}
+	return trips, dbfail(rows.Err())
+}
+
+//
+//  regionstats -- activity by region, for one grid or all
+//
+//  Faults are counted by istrouble, as everywhere else. SQL LIKE only
+//  picks the candidate events; it ignores case, so it finds more.
+//
+func (s *sqlstore) regionstats(grid string) ([]regionstat, error) {
+	where := ""
+	var args []interface{}
+	if grid != "" {
+		where = " WHERE grid = ?"
+		args = append(args, grid)
+	}
+	rows, err := s.db.Query("SELECT grid, region_name, COUNT(*), COUNT(DISTINCT tripid) FROM events"+where+
+		" GROUP BY grid, region_name ORDER BY grid, region_name", args...)
+	if err != nil {
+		return nil, dbfail(err)
+	}
+	defer rows.Close()
+	var stats []regionstat
+	bykey := make(map[regionkey]int) // index in stats
+	for rows.Next() {
+		var st regionstat
+		err = rows.Scan(&st.grid, &st.region_name, &st.events, &st.trips)
+		if err != nil {
+			return nil, dbfail(err)
+		}
+		bykey[regionkey{st.grid, st.region_name}] = len(stats)
+		stats = append(stats, st)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbfail(err)
+	}
+	if where == "" {
+		where = " WHERE"
+	} else {
+		where += " AND"
+	}
+	trows, err := s.db.Query("SELECT grid, region_name, eventtype FROM events"+where+
+		" (eventtype LIKE '%FAIL%' OR eventtype LIKE '%ERR%')", args...)
+	if err != nil {
+		return nil, dbfail(err)
+	}
+	defer trows.Close()
+	for trows.Next() {
+		var k regionkey
+		var eventtype string
+		err = trows.Scan(&k.grid, &k.region_name, &eventtype)
+		if err != nil {
+			return nil, dbfail(err)
+		}
+		if i, ok := bykey[k]; ok && istrouble(eventtype) {
+			stats[i].faults++
+		}
+	}
+	return stats, dbfail(trows.Err())
+}
+
+//
+//  boundarystats -- crossings by boundary, worst first, for one grid or all
+//
+//  Same totals and order as boundarytotals.
+//
+func (s *sqlstore) boundarystats(grid string, mincrossings int, limit int) ([]boundarystat, error) {
+	const failrate = "1.0 * SUM(CASE WHEN complete THEN 0 ELSE 1 END) / COUNT(*)"
+	const meanduration = "COALESCE(AVG(CASE WHEN complete THEN duration END), 0)"
+	query := "SELECT grid, region_a_x, region_a_y, region_b_x, region_b_y, MAX(region_a_name), MAX(region_b_name), " +
+		"COUNT(*), SUM(CASE WHEN complete THEN 0 ELSE 1 END), " + meanduration + ", " +
+		"COALESCE(MAX(CASE WHEN complete THEN duration END), 0), AVG(speed), " +
+		"COALESCE(AVG(CASE WHEN complete THEN pos_error END), 0), COALESCE(MAX(CASE WHEN complete THEN pos_error END), 0) FROM crossings"
+	var args []interface{}
+	if grid != "" {
+		query += " WHERE grid = ?"
+		args = append(args, grid)
+	}
+	query += " GROUP BY grid, region_a_x, region_a_y, region_b_x, region_b_y HAVING COUNT(*) >= ?" +
+		" ORDER BY " + failrate + " DESC, " + meanduration + " DESC, grid, region_a_x, region_a_y, region_b_x, region_b_y"
+	args = append(args, mincrossings)
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, dbfail(err)
+	}
+	defer rows.Close()
+	var stats []boundarystat
+	for rows.Next() {
+		var st boundarystat
+		err = rows.Scan(&st.grid, &st.region_a.X, &st.region_a.Y, &st.region_b.X, &st.region_b.Y,
+			&st.region_a.Name, &st.region_b.Name, &st.crossings, &st.incomplete, &st.mean_duration,
+			&st.max_duration, &st.mean_speed, &st.mean_error, &st.max_error)
+		if err != nil {
+			return nil, dbfail(err)
+		}
+		stats = append(stats, st)
+	}
+	return stats, dbfail(rows.Err())
+}
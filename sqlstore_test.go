@@ -0,0 +1,167 @@
+//
+//  Tests for SQL storage, run against SQLite
+//
+package main
+
+import (
+	"errors"
+	"github.com/mattn/go-sqlite3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//
+//  newtestsqlitestore -- an empty SQLite store in a temporary directory
+//
+func newtestsqlitestore(t *testing.T) (*sqlstore, func()) {
+	dir, err := ioutil.TempDir("", "vehiclelogtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := opensqlitestore(filepath.Join(dir, "vehicles.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, func() {
+		s.close()
+		os.RemoveAll(dir)
+	}
+}
+
+//
+//  forstores -- run check as a subtest against each kind of store
+//
+func forstores(t *testing.T, check func(t *testing.T, store vehstore)) {
+	t.Run("memory", func(t *testing.T) {
+		check(t, newmemstore())
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		s, cleanup := newtestsqlitestore(t)
+		defer cleanup()
+		check(t, s)
+	})
+}
+
+//
+//  forservers -- run check as a subtest against a test server on each kind of store
+//
+func forservers(t *testing.T, check func(t *testing.T, sv *FastCGIServer)) {
+	forstores(t, func(t *testing.T, store vehstore) {
+		sv := newtestserver(t)
+		sv.store = store
+		check(t, sv)
+	})
+}
+
+//
+//  mustappend -- store a test event, failing the test if it can't be
+//
+func mustappend(t *testing.T, store vehstore, hdr slheader, ev vehlogevent) {
+	if err := store.appendevent(hdr, ev, usednonce{}); err != nil {
+		t.Fatalf("Event %d of trip %s not stored: %s", ev.Serial, ev.Tripid, err)
+	}
+}
+
+//
+//  testevent -- a minimal event and header for storage tests
+//
+func testevent(tripid string, serial int32) (slheader, vehlogevent) {
+	var hdr slheader
+	hdr.Owner_name = "animats Resident"
+	hdr.Owner_key = "dadec334-539a-4875-ad0e-d9654705f437"
+	hdr.Object_name = "Logging tester 0.4"
+	hdr.Object_key = "b23730f8-4105-594a-c359-e72f9fece699"
+	hdr.Shard = "Production"
+	hdr.Grid = "Production"
+	hdr.Region = slregion{Name: "Vallone", X: 462592, Y: 306944}
+	hdr.Local_position = slvector{X: 204.783539, Y: 26.682831, Z: 35.563702}
+	ev := vehlogevent{Timestamp: 1521264571, Serial: serial, Tripid: tripid, Severity: 1, Eventtype: "STARTUP", Msg: "John Doe/Joe"}
+	return hdr, ev
+}
+
+func TestAppendEventAtomic(t *testing.T) {
+	s, cleanup := newtestsqlitestore(t)
+	defer cleanup()
+	defer func() { txfailpoint = nil }()
+	//  Fail between the event insert and the to-do insert
+	txfailpoint = func(where string) error { return errors.New("injected failure at " + where) }
+	tripid := GenerateRandomTripid()
+	hdr, ev := testevent(tripid, 0)
+	if err := s.appendevent(hdr, ev, usednonce{}); err == nil {
+		t.Fatalf("Injected failure not reported")
+	}
+	events, err := s.tripevents(tripid)
+	if err != nil || len(events) != 0 {
+		t.Errorf("Event stored by failed transaction: %d events, err %v", len(events), err)
+	}
+	agetodo(t, s)
+	if _, _, err = s.pendingtrip(); err != errNoPendingTrip {
+		t.Errorf("To-do entry stored by failed transaction, err %v", err)
+	}
+	//  Without the failure, both writes happen
+	txfailpoint = nil
+	if err := s.appendevent(hdr, ev, usednonce{}); err != nil {
+		t.Fatal(err)
+	}
+	events, _ = s.tripevents(tripid)
+	agetodo(t, s)
+	if id, _, err := s.pendingtrip(); len(events) != 1 || id != tripid || err != nil {
+		t.Errorf("Event insert incomplete: %d events, to-do \"%s\", err %v", len(events), id, err)
+	}
+}
+
+func TestWriteTripSummaryAtomic(t *testing.T) {
+	s, cleanup := newtestsqlitestore(t)
+	defer cleanup()
+	defer func() { txfailpoint = nil }()
+	tripid := GenerateRandomTripid()
+	hdr, ev := testevent(tripid, 0)
+	if err := s.appendevent(hdr, ev, usednonce{}); err != nil {
+		t.Fatal(err)
+	}
+	agetodo(t, s)
+	_, stamp, err := s.claimtrip("test", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := tripsummary{tripid: tripid, stamp: stamp, trip_status: "OK", data_status: "OK"}
+	//  Fail between the trip insert and the to-do delete
+	txfailpoint = func(where string) error { return errors.New("injected failure at " + where) }
+	if err := s.writetripsummary("test", r); err == nil {
+		t.Fatalf("Injected failure not reported")
+	}
+	if _, err := s.loadtripsummary(tripid); err != errNoTrip {
+		t.Errorf("Trip stored by failed transaction, err %v", err)
+	}
+	var todo int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM tripstodo WHERE tripid = ? AND lease_owner = 'test'", tripid).Scan(&todo); todo != 1 || err != nil {
+		t.Errorf("To-do entry or lease changed by failed transaction, err %v", err)
+	}
+}
+
+func TestTransactionRetry(t *testing.T) {
+	s, cleanup := newtestsqlitestore(t)
+	defer cleanup()
+	defer func() { txfailpoint = nil }()
+	//  Fail once with a retryable error, then succeed
+	tries := 0
+	txfailpoint = func(where string) error {
+		tries++
+		if tries == 1 {
+			return sqlite3.Error{Code: sqlite3.ErrBusy}
+		}
+		return nil
+	}
+	tripid := GenerateRandomTripid()
+	hdr, ev := testevent(tripid, 0)
+	if err := s.appendevent(hdr, ev, usednonce{}); err != nil {
+		t.Fatalf("Retry failed: %s", err)
+	}
+	events, _ := s.tripevents(tripid)
+	if tries != 2 || len(events) != 1 {
+		t.Errorf("Expected 2 tries and 1 event, got %d tries and %d events", tries, len(events))
+	}
+}
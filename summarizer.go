@@ -7,9 +7,8 @@
 package main
 
 import (
-	"database/sql"
-	"errors"
 	"fmt"
+	"log"
 	"strings"
 	"time"
 )
@@ -17,15 +16,10 @@ import (
 //
 //  Constants
 //
-const runEverySecs = 30      // run this no more than once per N seconds
-const minSummarizeSecs = 120 // summarize if oldest event is older than this 
+const runEverySecs = 30      // default: look for finished trips every N seconds
+const minSummarizeSecs = 120 // default: summarize if newest event is older than this
 const keeplasteventtypes = 6 // keep this many event types in log
 
-//
-//  Static variables
-//
-var lastSummarizeTime time.Time // last time we ran summarization. Zero at init
-
 //
 //  Types
 //
@@ -35,6 +29,18 @@ type trip struct { // used during summarization
 	event_distance float64     // distance computed from events as check
 	starttime      int64       // starting time, UNIX
 	sx             tripsummary // trip summary to go to database
+	region         slregion    // region of latest event
+	fromregion     slregion    // region before that one
+	crossed        bool        // crossing into region recorded
+	crosspending   bool        // last crossing awaits its CROSSEND
+	crosspos       slglobalpos // position at last CROSSSPEED
+	prevtime       int64       // time of previous event, UNIX
+	prevtype       string      // type of previous event
+	faultreasons   []string    // falls, jumps, flips, and spins, for msg
+	speedsamples   int         // events with velocity and rotation
+	prevheading    float64     // heading at previous such event, degrees
+	flipped        bool        // upside down at previous such event
+	spinning       bool        // spun out at previous such event
 }
 type tripsummary struct {
 
@@ -43,22 +49,40 @@ type tripsummary struct {
 	elapsed             int32       // elapsed time
 	tripid              string      // ID of trip
 	owner_name          string      // name of owner
-	shard               string      // grid name
+	owner_key           string      // owner UUID, empty for trips logged before keys were
+	shard               string      // server shard
+	grid                string      // grid name
 	object_name         string      // object name
+	object_key          string      // object UUID, empty for trips logged before keys were
 	driver_key          string      // 36 chars of key, may be empty
 	driver_name         string      // name of driver
 	driver_display_name string      // display name of driver
 	distance            float64     // distance traveled, from client
 	regions_crossed     int32       // number of region crossings
 	trip_status         string      // ENUM("OK","FAULT","NOSHUTDOWN"), // how did trip end?
+	ended_shutdown      bool        // last event was SHUTDOWN; later events for the trip are late
 	data_status         string      // ENUM("OK","MISSING","INCONSISTENT"), // data problems
 	severity            int8        // worst severity level
 	start_region_name   string      // starting region
 	end_region_name     string      // ending region
-	min_pos             slglobalpos // min X value, global
-	max_pos             slglobalpos // max X value, global
+	min_pos             slglobalpos // min X, Y, and Z values, global
+	max_pos             slglobalpos // max X, Y, and Z values, global
 	last_eventtypes     []string    // last N event types recorded
 	msg                 string      // message if any
+	clock_skew          int32       // server time minus client time, median, seconds
+	suspect_events      int32       // events with suspect timestamps
+	late_events         int32       // events which arrived after trip was first summarized
+	max_speed           float64     // fastest speed sent with an event, meters/sec
+	avg_speed           float64     // mean of speeds sent with events, meters/sec
+	heading_change      float64     // total turning, degrees
+	flips               int32       // times vehicle turned upside down
+	spins               int32       // times vehicle spun out
+	revision            int32       // times summarized, set by store
+	recomputed          time.Time   // when last summarized, set by store
+
+	segments  []tripsegment // per region, in order visited, stored in tripsegments
+	crossings []crossing    // region crossings, in order, stored in crossings
+	falls     []fall        // sudden altitude changes, in order, stored in falls
 }
 
 func (r tripsummary) String() string {
@@ -75,80 +99,6 @@ func (r trip) String() string {
 		r.event_distance/1000.0)
 }
 
-//
-//  inserttrip -- insert trip info in database
-//
-//  Ignore duplicates
-//
-func inserttrip(db *sql.DB, r tripsummary) error {
-	//   Convert last eventtypes into TYPE-TYPE-TYPE for SQL
-	const insstmt string = "INSERT IGNORE INTO trips (stamp, elapsed, tripid, owner_name, shard, object_name, driver_key, driver_name, driver_display_name, distance, regions_crossed, trip_status, data_status, severity, start_region_name, end_region_name, min_pos_x, min_pos_y, max_pos_x, max_pos_y, last_eventtypes, msg) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)"
-	_, err := db.Exec(insstmt,
-		r.stamp,
-		r.elapsed,
-		r.tripid,
-		r.owner_name,
-		r.shard,
-		r.object_name,
-		r.driver_key,
-		r.driver_name,
-		r.driver_display_name,
-		r.distance,
-		r.regions_crossed,
-		r.trip_status,
-		r.data_status,
-		r.severity,
-		r.start_region_name,
-		r.end_region_name,
-		r.min_pos.X,
-		r.min_pos.Y,
-		r.max_pos.X,
-		r.max_pos.Y,
-		strings.Join(r.last_eventtypes, ", "),
-		r.msg)
-	return err
-}
-
-//
-//  deletetodo  -- delete to-do entry from to-do list
-//
-func deletetodo(db *sql.DB, tripid string) error {
-	if tripid == "" {
-		return (errors.New("deletetodo: empty tripid"))
-	}
-	_, err := db.Exec("DELETE FROM tripstodo WHERE tripid = ?", tripid)
-	return (err)
-}
-
-//
-//  updatetripdb  -- update trip database from trip record
-//
-//  Also deletes corresponding record from tripstodo.
-//
-//  Duplicate tripid - ignore update
-//
-func updatetripdb(db *sql.DB, r tripsummary) error {
-	tx, err := db.Begin() // updating events and tripstodo
-	if err != nil {
-		return err
-	}
-	err = inserttrip(db, r)
-	if err == nil {
-		err = deletetodo(db, r.tripid)
-		if err == nil {
-			err = tx.Commit() // success
-			if err != nil {
-				return err
-			}
-
-		} // all OK, commit
-	}
-	if err != nil {
-		_ = tx.Rollback() // fail, undo
-	}
-	return err
-}
-
 //
 //  updatefromeevent -- update trip object given a log entry
 //
@@ -162,8 +112,11 @@ func (r *trip) updatefromevent(event vehlogevent, hdr slheader, first bool) {
 			r.sx.data_status = "OK"
 			r.sx.object_name = hdr.Object_name
 			r.sx.owner_name = hdr.Owner_name
+			r.sx.owner_key = hdr.Owner_key
+			r.sx.object_key = hdr.Object_key
 			r.sx.object_name = hdr.Object_name
 			r.sx.shard = hdr.Shard
+			r.sx.grid = hdr.Grid
 			names := strings.SplitN(event.Msg, "/", 2) // split into legacy name / display name
 			if len(names) == 2 {
 				r.sx.driver_name = names[0]
@@ -193,8 +146,7 @@ func (r *trip) updatefromevent(event vehlogevent, hdr slheader, first bool) {
 
 	//  For all records
 	//  Consistency checks
-	consistent := hdr.Owner_name == r.sx.owner_name && hdr.Object_name == r.sx.object_name &&
-		hdr.Shard == r.sx.shard
+	consistent := r.sameobject(hdr) && hdr.Shard == r.sx.shard && hdr.Grid == r.sx.grid
 	sequential := r.serial+1 == event.Serial // should be in sequence
 	if r.sx.data_status == "OK" && !consistent {
 		r.sx.data_status = "INCONSISTENT"
@@ -203,9 +155,14 @@ func (r *trip) updatefromevent(event vehlogevent, hdr slheader, first bool) {
 		r.sx.data_status = "MISSING"
 	}
 	r.serial = event.Serial
+	if event.Suspect {
+		r.sx.suspect_events++
+	}
+	if event.Late {
+		r.sx.late_events++
+	}
 	//  Significant bad event?
-	trouble := strings.Contains(event.Eventtype, "FAIL") || strings.Contains(event.Eventtype, "ERR")
-	if trouble && r.sx.trip_status == "OK" {
+	if istrouble(event.Eventtype) && r.sx.trip_status == "OK" {
 		r.sx.trip_status = "FAULT"
 	}
 	//  Distance calc
@@ -215,34 +172,82 @@ func (r *trip) updatefromevent(event vehlogevent, hdr slheader, first bool) {
 	r.sx.end_region_name = hdr.Region.Name
 	r.sx.min_pos.Min(gpos) // update corners of area traveled
 	r.sx.max_pos.Max(gpos)
-	r.event_distance += r.prevpos.Distance(gpos)                         // accumulate distance
+	leg := r.prevpos.Distance(gpos)
+	r.updatesegments(event, hdr, gpos, leg)
+	r.updatefalls(event, hdr, gpos)
+	r.updatemotion(event, hdr)
+	r.updatecrossings(event, hdr, gpos)
+	r.event_distance += leg                                              // accumulate distance
 	r.prevpos = gpos                                                     // previous position
 	r.sx.last_eventtypes = append(r.sx.last_eventtypes, event.Eventtype) // recent event types (could truncate this)
 }
 
 //
-//  doonetrpiid  -- handle one trip ID
+//  addfault -- trip is a fault, for reason, which goes in msg
+//
+func (r *trip) addfault(reason string) {
+	if r.sx.trip_status == "OK" {
+		r.sx.trip_status = "FAULT"
+	}
+	r.faultreasons = append(r.faultreasons, reason)
+	r.sx.msg = strings.Join(r.faultreasons, "; ")
+}
+
 //
-func doonetripid(db *sql.DB, tripid string, stamp time.Time, verbose bool) error {
+//  sameobject -- true if event came from the trip's object, with the same owner
+//
+//  By key, since names change. Events logged before keys were have only names.
+//
+func (r *trip) sameobject(hdr slheader) bool {
+	if hdr.Owner_key == "" && r.sx.owner_key == "" {
+		return hdr.Owner_name == r.sx.owner_name && hdr.Object_name == r.sx.object_name
+	}
+	return hdr.Owner_key == r.sx.owner_key && hdr.Object_key == r.sx.object_key
+}
+
+//
+//  istrouble -- true for event types which are significant bad events
+//
+//  The one definition of a fault. sqlstore.regionstats narrows events
+//  down with SQL first, but counts with this.
+//
+func istrouble(eventtype string) bool {
+	return strings.Contains(eventtype, "FAIL") || strings.Contains(eventtype, "ERR")
+}
+
+//
+//  doonetrpiid  -- handle one trip ID, leased to worker
+//
+func doonetripid(store vehstore, worker string, tripid string, stamp time.Time, verbose bool) error {
+	r, err := summarizetrip(store, tripid, stamp, verbose)
+	if err != nil {
+		return err
+	}
+	return store.writetripsummary(worker, r) // update the database
+}
+
+//
+//  summarizetrip -- compute summary of one trip from its events
+//
+func summarizetrip(store vehstore, tripid string, stamp time.Time, verbose bool) (tripsummary, error) {
 	if verbose {
 		fmt.Printf("Summarizing trip %s (%s)\n", tripid, stamp)
 	}
 	//  Read events for this trip in serial order
-	rows, err := db.Query("SELECT tripid, time, shard, owner_name, object_name, region_name, region_corner_x, region_corner_y, local_position_x, local_position_y, local_position_z, severity, eventtype, msg, auxval, serial FROM events WHERE tripid = ? ORDER BY serial", tripid)
+	events, err := store.tripevents(tripid)
 	if err != nil {
-		return err
+		return tripsummary{}, err
+	}
+	if len(events) == 0 {
+		return tripsummary{}, errNoTrip
 	}
-	defer rows.Close()
 	var tr trip           // working trip
 	var first bool = true // first
 	var lastevent vehlogevent
 
-	for rows.Next() { // over all rows
-		var event vehlogevent
-		var hdr slheader
-		err = rows.Scan(&event.Tripid, &event.Timestamp, &hdr.Shard, &hdr.Owner_name, &hdr.Object_name, &hdr.Region.Name, &hdr.Region.X, &hdr.Region.Y,
-			&hdr.Local_position.X, &hdr.Local_position.Y, &hdr.Local_position.Z,
-			&event.Severity, &event.Eventtype, &event.Msg, &event.Auxval, &event.Serial)
+	for _, te := range events { // over all rows
+		event := te.ev
+		hdr := te.hdr
 		if verbose {
 			fmt.Printf("%4d. %12s %s %s %s %f\n", event.Serial, event.Eventtype, hdr.Region.Name, hdr.Local_position, event.Msg, event.Auxval)
 		}
@@ -254,6 +259,7 @@ func doonetripid(db *sql.DB, tripid string, stamp time.Time, verbose bool) error
 	//  Last event processing
 	if lastevent.Eventtype == "SHUTDOWN" {
 		tr.sx.distance = float64(lastevent.Auxval) // get distance traveled
+		tr.sx.ended_shutdown = true
 	} else {
 		if tr.sx.trip_status == "OK" {
 			tr.sx.trip_status = "NOSHUTDOWN" // log ended incomplete
@@ -263,52 +269,85 @@ func doonetripid(db *sql.DB, tripid string, stamp time.Time, verbose bool) error
 		tr.sx.last_eventtypes = tr.sx.last_eventtypes[len(tr.sx.last_eventtypes)-keeplasteventtypes:] // keep last N
 	}
 	tr.sx.elapsed = int32(lastevent.Timestamp - tr.starttime)  // elapsed time
-	tr.sx.stamp = stamp                                         // timestamp trip (end time)
+	skew, known := clockskew(events)
+	if known {
+		tr.sx.clock_skew = int32(skew)
+		if skewlimit.outside(skew) || tr.sx.suspect_events > 0 { // script clock is wrong, use corrected times
+			tr.sx.elapsed = int32(correctedtime(lastevent, skew) - correctedtime(events[0].ev, skew))
+		}
+	}
+	tr.sx.stamp = stamp // timestamp trip (end time)
 	if verbose {
 		fmt.Printf("Summary: %s\n", tr)
 	}
-	err = updatetripdb(db, tr.sx) // update the database
-	return err
+	return tr.sx, nil
 }
 
 //
-//  dosummarize -- run a summarize cycle if not run recently
+//  logsummarizeerror -- record failure to summarize a trip in the error log
 //
-func dosummarize(db *sql.DB, verbose bool) error {
-
-	if !lastSummarizeTime.IsZero() && time.Since(lastSummarizeTime).Seconds() < minSummarizeSecs {
-		return nil // too soon, try later
+func logsummarizeerror(store vehstore, tripid string, err error) {
+	var owner, ownerkey string
+	events, lerr := store.tripevents(tripid) // owner, if we can get it
+	if lerr == nil && len(events) > 0 {
+		owner, ownerkey = events[0].hdr.Owner_name, events[0].hdr.Owner_key
 	}
-	lastSummarizeTime = time.Now() // update time stamp
+	recorderror(store, ownersource(ownerkey), errorlogentry{owner_name: owner, tripid: tripid, category: categorysummarize,
+		msg: fmt.Sprintf("Unable to summarize trip: %s", err)})
+}
 
+//
+//  dosummarize -- summarize all finished trips
+//
+//  Returns the number of trips summarized. Run by the summaryworker, not
+//  by request handling. Each trip is leased to worker while it is summarized,
+//  so any number of workers, in any number of processes, can run at once.
+//
+//  A trip which fails is logged and skipped, and keeps its lease, so it is
+//  retried when the lease expires. The other trips go on. The error returned
+//  is the last such failure, or a storage failure which stopped the cycle.
+//
+func dosummarize(store vehstore, worker string, verbose bool) (int, error) {
 	if verbose {
 		fmt.Printf("Starting summarization.\n")
 	}
-
-	for { // unti no more work to do
-		//  Get earliest tripid at least minSummarizeSeconds old.
+	n := 0
+	var lasterr error       // last trip which failed
+	for !isshuttingdown() { // until no more work to do, or shutting down
+		//  Claim earliest tripid of a trip which is over, per tripend.
 		//  We do this one at a time because there might be other summarizers running.
-		row := db.QueryRow("SELECT tripid, stamp FROM tripstodo WHERE TIMESTAMPDIFF(SECOND, stamp, NOW()) > ? ORDER BY stamp LIMIT 1", minSummarizeSecs)
-		var tripid string // trip ID to be processed
-		var stamp time.Time
-		err := row.Scan(&tripid, &stamp)
-		if err == sql.ErrNoRows {
+		tripid, stamp, err := store.claimtrip(worker, summarizelease)
+		if err == errNoPendingTrip {
 			if verbose {
 				fmt.Printf("Done.\n")
 			}
 			break
 		} // normal EOF
 		if err != nil {
-			return err
+			return n, err
 		}
-		if err != nil {
-			return err
+		err = doonetripid(store, worker, tripid, stamp, verbose)
+		if err == errLeaseLost { // took too long; the worker which has the trip now writes it
+			log.Printf("Lease on trip %s expired while summarizing, not written", tripid)
+			continue
 		}
-		err = doonetripid(db, tripid, stamp, verbose)
-		if err != nil {
-			return err
+		if err == errNoTrip { // to-do entry with no events; nothing to summarize, ever
+			err = store.droptodo(worker, tripid, stamp)
+			if err == nil {
+				continue
+			}
+		}
+		if err != nil { // lease stays, so trip is retried when it expires
+			logsummarizeerror(store, tripid, err)
+			if e, ok := err.(*dberror); ok && e.unavailable { // later trips would fail too
+				return n, err
+			}
+			log.Printf("Unable to summarize trip %s, skipping it: %s", tripid, err)
+			lasterr = err
+			continue
 		}
-		time.Sleep(500 * time.Millisecond) // avoid overloading server
+		n++
+		time.Sleep(summarizepause) // avoid overloading server
 	}
-	return nil // normal end
+	return n, lasterr // normal end
 }
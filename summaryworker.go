@@ -0,0 +1,213 @@
+//
+//  summaryworker -- summarizes finished trips in the background
+//
+//  Runs on a timer, so the last trip of the night gets summarized without
+//  waiting for someone to drive again, and no request waits on the summarizer.
+//  An admin listener can pause, resume, or trigger it. It can also run as
+//  a separate process with "-mode summarize".
+//
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+//  Constants
+//
+const defaultleasesecs = 600 // a worker's claim on a trip expires after this
+
+//
+//  summarizepause -- time between trips, to avoid overloading server. Replaceable for testing.
+//
+var summarizepause = 500 * time.Millisecond
+
+//
+//  summarizelease -- how long a worker's claim on a trip lasts. Set from config by initserver.
+//
+var summarizelease = defaultleasesecs
+
+//
+//  newworkerid -- name for a summarizer, unique across processes and hosts
+//
+var workercount int32
+
+func newworkerid() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d:%d", host, os.Getpid(), atomic.AddInt32(&workercount, 1))
+}
+
+//
+//  summaryworker -- the background summarizer
+//
+type summaryworker struct {
+	id       string        // worker ID, for trip leases
+	store    vehstore      // where the trips are
+	interval time.Duration // time between cycles
+	verbose  bool          // print trips as summarized
+	trigger  chan struct{} // run a cycle now
+	quit     chan struct{} // closed to stop
+	done     chan struct{} // closed when stopped
+	mu       sync.Mutex    // protects the fields below
+	paused   bool          // no timed cycles
+	running  bool          // cycle in progress
+	lastrun  time.Time     // start of last cycle
+	lasterr  error         // result of last cycle
+	trips    int64         // trips summarized since start
+}
+
+//
+//  summarizerstatus -- reply to admin requests
+//
+type summarizerstatus struct {
+	Paused   bool   `json:"paused"`   // no timed cycles
+	Running  bool   `json:"running"`  // cycle in progress
+	Lastrun  int64  `json:"lastrun"`  // start of last cycle, UNIX time, 0 if none
+	Lasterr  string `json:"lasterr"`  // error from last cycle, if any
+	Trips    int64  `json:"trips"`    // trips summarized since start
+	Interval int64  `json:"interval"` // seconds between cycles
+}
+
+func newsummaryworker(store vehstore, intervalsecs int, verbose bool) *summaryworker {
+	if intervalsecs <= 0 {
+		intervalsecs = runEverySecs
+	}
+	return &summaryworker{
+		id:       newworkerid(),
+		store:    store,
+		interval: time.Duration(intervalsecs) * time.Second,
+		verbose:  verbose,
+		trigger:  make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+//
+//  run -- summarize every interval until stopped. Run as a goroutine.
+//
+//  A triggered cycle runs even when paused.
+//
+func (w *summaryworker) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.quit:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			paused := w.paused
+			w.mu.Unlock()
+			if !paused {
+				w.cycle()
+			}
+		case <-w.trigger:
+			w.cycle()
+		}
+	}
+}
+
+//
+//  cycle -- one summarize run
+//
+func (w *summaryworker) cycle() {
+	w.mu.Lock()
+	w.running = true
+	w.lastrun = time.Now()
+	w.mu.Unlock()
+	n, err := dosummarize(w.store, w.id, w.verbose)
+	if err != nil {
+		log.Printf("Summarization failed: %s", err) // also in errorlog, if it was a trip
+	}
+	w.mu.Lock()
+	w.running = false
+	w.lasterr = err
+	w.trips += int64(n)
+	w.mu.Unlock()
+}
+
+//
+//  stop -- stop the worker, waiting for a cycle in progress
+//
+func (w *summaryworker) stop() {
+	close(w.quit)
+	<-w.done
+}
+
+func (w *summaryworker) pause(paused bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.paused = paused
+}
+
+//
+//  runnow -- start a cycle as soon as the worker is free
+//
+func (w *summaryworker) runnow() {
+	select {
+	case w.trigger <- struct{}{}:
+	default: // already triggered
+	}
+}
+
+func (w *summaryworker) status() summarizerstatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	st := summarizerstatus{Paused: w.paused, Running: w.running, Trips: w.trips, Interval: int64(w.interval.Seconds())}
+	if !w.lastrun.IsZero() {
+		st.Lastrun = w.lastrun.Unix()
+	}
+	if w.lasterr != nil {
+		st.Lasterr = w.lasterr.Error()
+	}
+	return st
+}
+
+//
+//  adminhandler -- admin requests for the summarizer
+//
+//  GET /summarizer for status. POST /summarizer/pause, /summarizer/resume,
+//  or /summarizer/run. No authentication, so listen only on localhost.
+//
+func adminhandler(w *summaryworker) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/summarizer", func(rw http.ResponseWriter, req *http.Request) {
+		writestatus(rw, http.StatusOK, w.status())
+	})
+	actions := map[string]func(){
+		"/summarizer/pause":  func() { w.pause(true) },
+		"/summarizer/resume": func() { w.pause(false) },
+		"/summarizer/run":    w.runnow,
+	}
+	for path, action := range actions {
+		action := action
+		mux.HandleFunc(path, func(rw http.ResponseWriter, req *http.Request) {
+			if req.Method != http.MethodPost {
+				rw.Header().Set("Allow", http.MethodPost)
+				http.Error(rw, "POST required", http.StatusMethodNotAllowed)
+				return
+			}
+			action()
+			writestatus(rw, http.StatusOK, w.status())
+		})
+	}
+	return mux
+}
+
+func writestatus(rw http.ResponseWriter, httpstatus int, st summarizerstatus) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(httpstatus)
+	json.NewEncoder(rw).Encode(st)
+}
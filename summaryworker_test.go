@@ -0,0 +1,374 @@
+//
+//  Tests for the background summarizer
+//
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+//
+//  addfinishedtrip -- put a trip on the to-do list, old enough to summarize
+//
+func addfinishedtrip(t *testing.T, ms *memstore) string {
+	tripid := GenerateRandomTripid()
+	hdr, ev := testevent(tripid, 0)
+	mustappend(t, ms, hdr, ev)
+	ms.mu.Lock()
+	td := ms.todo[tripid]
+	td.stamp = time.Now().Add(-time.Hour) // last event an hour ago
+	ms.todo[tripid] = td
+	ms.mu.Unlock()
+	return tripid
+}
+
+//
+//  waitsummarized -- wait for the worker to summarize a trip
+//
+func waitsummarized(store vehstore, tripid string, wait time.Duration) bool {
+	for end := time.Now().Add(wait); time.Now().Before(end); time.Sleep(10 * time.Millisecond) {
+		if _, err := store.loadtripsummary(tripid); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSummaryWorker(t *testing.T) {
+	ms := newmemstore()
+	w := newsummaryworker(ms, 0, false)
+	w.interval = 20 * time.Millisecond
+	go w.run()
+	defer w.stop()
+	tripid := addfinishedtrip(t, ms)
+	if !waitsummarized(ms, tripid, 2*time.Second) {
+		t.Fatalf("Trip not summarized on timer")
+	}
+	//  Paused, timed cycles don't run, but a triggered one does
+	w.pause(true)
+	time.Sleep(3 * w.interval) // let any cycle in progress finish
+	tripid = addfinishedtrip(t, ms)
+	if waitsummarized(ms, tripid, 10*w.interval) {
+		t.Fatalf("Trip summarized while paused")
+	}
+	w.runnow()
+	if !waitsummarized(ms, tripid, 2*time.Second) {
+		t.Fatalf("Trip not summarized on trigger")
+	}
+	time.Sleep(summarizepause + 2*w.interval) // cycle ends after a pause
+	if st := w.status(); !st.Paused || st.Trips != 2 || st.Lastrun == 0 || st.Lasterr != "" {
+		t.Errorf("Status: %+v", st)
+	}
+}
+
+func TestSummaryWorkerAdmin(t *testing.T) {
+	w := newsummaryworker(newmemstore(), 0, false)
+	h := adminhandler(w)
+	for _, test := range []struct {
+		method string
+		path   string
+		status int
+		paused bool
+	}{
+		{"POST", "/summarizer/pause", http.StatusOK, true},
+		{"GET", "/summarizer", http.StatusOK, true},
+		{"GET", "/summarizer/resume", http.StatusMethodNotAllowed, true},
+		{"POST", "/summarizer/resume", http.StatusOK, false},
+		{"POST", "/summarizer/run", http.StatusOK, false},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(test.method, test.path, nil))
+		if rec.Code != test.status {
+			t.Errorf("%s %s: got status %d, expected %d", test.method, test.path, rec.Code, test.status)
+			continue
+		}
+		if w.status().Paused != test.paused {
+			t.Errorf("%s %s: paused %v, expected %v", test.method, test.path, w.status().Paused, test.paused)
+		}
+		if rec.Code == http.StatusOK {
+			var st summarizerstatus
+			if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil || st.Interval != runEverySecs {
+				t.Errorf("%s %s: bad status reply \"%s\", %v", test.method, test.path, rec.Body.String(), err)
+			}
+		}
+	}
+	if len(w.trigger) != 1 {
+		t.Errorf("Run request did not trigger a cycle")
+	}
+}
+
+func TestCheckAdmin(t *testing.T) {
+	tests := []struct {
+		mode        string
+		adminlisten string
+		external    bool
+		ok          bool
+	}{
+		{"", "localhost:8081", false, false}, // every fcgi process would run a summarizer
+		{"fcgi", "localhost:8081", false, false},
+		{"fcgi", "localhost:8081", true, true}, // summarize process takes admin requests
+		{"fcgi", "", false, true},
+		{"http", "localhost:8081", false, true},
+		{"summarize", "localhost:8081", true, true},
+	}
+	for _, test := range tests {
+		if err := checkadmin(test.mode, test.adminlisten, test.external); (err == nil) != test.ok {
+			t.Errorf("Mode \"%s\", Adminlisten \"%s\", External %v: got %v", test.mode, test.adminlisten, test.external, err)
+		}
+	}
+}
+
+func TestRequestDoesNotSummarize(t *testing.T) {
+	sv := newtestserver(t)
+	tripid := addfinishedtrip(t, sv.store.(*memstore))
+	testjson := []byte(`{"timestamp":1521264571,"tripid":"` + GenerateRandomTripid() + `","eventtype":"STARTUP"}`)
+	postevent(t, sv, testjson, signedheader(testjson))
+	if _, err := sv.store.loadtripsummary(tripid); err != errNoTrip {
+		t.Errorf("Request ran the summarizer, err %v", err)
+	}
+}
+
+//
+//  countingstore -- counts trip summaries written, by trip
+//
+type countingstore struct {
+	vehstore
+	mu     sync.Mutex
+	writes map[string]int
+}
+
+func (s *countingstore) writetripsummary(worker string, r tripsummary) error {
+	s.mu.Lock()
+	s.writes[r.tripid]++
+	s.mu.Unlock()
+	time.Sleep(time.Millisecond) // give other workers a chance to collide
+	return s.vehstore.writetripsummary(worker, r)
+}
+
+//
+//  checkconcurrentsummarize -- several workers on one to-do list summarize each trip once
+//
+func checkconcurrentsummarize(t *testing.T, store vehstore) {
+	const ntrips = 30
+	const nworkers = 4
+	defer func(pause time.Duration) { summarizepause = pause }(summarizepause)
+	summarizepause = 0
+	var tripids []string
+	for i := 0; i < ntrips; i++ {
+		tripid := GenerateRandomTripid()
+		hdr, ev := testevent(tripid, 0)
+		if err := store.appendevent(hdr, ev, usednonce{}); err != nil {
+			t.Fatal(err)
+		}
+		tripids = append(tripids, tripid)
+	}
+	agetodo(t, store)
+	cs := &countingstore{vehstore: store, writes: make(map[string]int)}
+	var wg sync.WaitGroup
+	counts := make([]int, nworkers)
+	for i := 0; i < nworkers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			n, err := dosummarize(cs, fmt.Sprintf("worker%d", i), false)
+			if err != nil {
+				t.Errorf("Worker %d: %s", i, err)
+			}
+			counts[i] = n
+		}(i)
+	}
+	wg.Wait()
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	if total != ntrips {
+		t.Errorf("Workers summarized %d trips, expected %d", total, ntrips)
+	}
+	for _, tripid := range tripids {
+		if cs.writes[tripid] != 1 {
+			t.Errorf("Trip %s summarized %d times", tripid, cs.writes[tripid])
+		}
+	}
+	agetodo(t, store)
+	if _, _, err := store.pendingtrip(); err != errNoPendingTrip {
+		t.Errorf("To-do list not empty, err %v", err)
+	}
+}
+
+func TestConcurrentSummarize(t *testing.T) {
+	forstores(t, checkconcurrentsummarize)
+}
+
+//
+//  checklease -- a claimed trip is not claimed again until the lease expires
+//
+func checklease(t *testing.T, store vehstore) {
+	tripid := GenerateRandomTripid()
+	hdr, ev := testevent(tripid, 0)
+	mustappend(t, store, hdr, ev)
+	agetodo(t, store)
+	if id, _, err := store.claimtrip("worker1", 60); id != tripid || err != nil {
+		t.Fatalf("Claim failed: \"%s\", %v", id, err)
+	}
+	if id, _, err := store.claimtrip("worker2", 60); err != errNoPendingTrip {
+		t.Errorf("Leased trip claimed again: \"%s\", %v", id, err)
+	}
+	if _, _, err := store.pendingtrip(); err != errNoPendingTrip {
+		t.Errorf("Leased trip still pending, err %v", err)
+	}
+	//  Worker dies. Its lease runs out, and another worker takes the trip.
+	tripid = GenerateRandomTripid()
+	hdr, ev = testevent(tripid, 0)
+	mustappend(t, store, hdr, ev)
+	agetodo(t, store)
+	if id, _, err := store.claimtrip("worker1", -1); id != tripid || err != nil {
+		t.Fatalf("Claim failed: \"%s\", %v", id, err)
+	}
+	if id, _, err := store.claimtrip("worker2", 60); id != tripid || err != nil {
+		t.Errorf("Expired lease not reclaimed: \"%s\", %v", id, err)
+	}
+}
+
+func TestLease(t *testing.T) {
+	forstores(t, checklease)
+}
+
+//
+//  checkleaseowner -- only the worker holding a trip's lease takes it off the to-do list
+//
+func checkleaseowner(t *testing.T, store vehstore) {
+	tripid := GenerateRandomTripid()
+	hdr, ev := testevent(tripid, 0)
+	if err := store.appendevent(hdr, ev, usednonce{}); err != nil {
+		t.Fatal(err)
+	}
+	agetodo(t, store)
+	_, stamp, err := store.claimtrip("worker1", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := tripsummary{tripid: tripid, stamp: stamp, trip_status: "OK", data_status: "OK"}
+	if err := store.writetripsummary("worker2", r); err != errLeaseLost { // lease expired, as worker2 thinks
+		t.Fatalf("Write by worker without the lease: %v, expected errLeaseLost", err)
+	}
+	if _, err := store.loadtripsummary(tripid); err != errNoTrip {
+		t.Errorf("Trip written by worker without the lease, err %v", err)
+	}
+	if id, _, err := store.claimtrip("worker3", 60); err != errNoPendingTrip {
+		t.Errorf("Lease released by another worker: \"%s\" claimed, %v", id, err)
+	}
+	if err := store.writetripsummary("worker1", r); err != nil {
+		t.Fatal(err)
+	}
+	agetodo(t, store)
+	if id, _, err := store.pendingtrip(); err != errNoPendingTrip {
+		t.Errorf("Trip still on to-do list after lease holder wrote it: \"%s\", %v", id, err)
+	}
+}
+
+func TestLeaseOwner(t *testing.T) {
+	forstores(t, checkleaseowner)
+}
+
+//
+//  checkleaselost -- a worker whose lease expired and was taken over writes nothing
+//
+func checkleaselost(t *testing.T, store vehstore) {
+	tripid := GenerateRandomTripid()
+	hdr, ev := testevent(tripid, 0)
+	mustappend(t, store, hdr, ev)
+	agetodo(t, store)
+	_, stamp, err := store.claimtrip("worker1", -1) // worker1 is slow, and its lease runs out
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _, err := store.claimtrip("worker2", 60); id != tripid || err != nil {
+		t.Fatalf("Expired lease not reclaimed: \"%s\", %v", id, err)
+	}
+	stale := tripsummary{tripid: tripid, stamp: stamp, trip_status: "NOSHUTDOWN", data_status: "OK"}
+	if err := store.writetripsummary("worker1", stale); err != errLeaseLost {
+		t.Fatalf("Write after lease expired: %v, expected errLeaseLost", err)
+	}
+	if _, err := store.loadtripsummary(tripid); err != errNoTrip {
+		t.Errorf("Trip written after lease expired, err %v", err)
+	}
+	r := tripsummary{tripid: tripid, stamp: stamp, trip_status: "OK", data_status: "OK"}
+	if err := store.writetripsummary("worker2", r); err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := store.loadtripsummary(tripid); r.trip_status != "OK" || r.revision != 1 {
+		t.Errorf("Trip written by lease holder: status %s, revision %d", r.trip_status, r.revision)
+	}
+	if err := store.writetripsummary("worker1", stale); err != errLeaseLost { // to-do entry gone
+		t.Errorf("Write after trip taken off to-do list: %v, expected errLeaseLost", err)
+	}
+}
+
+func TestLeaseLost(t *testing.T) {
+	forstores(t, checkleaselost)
+}
+
+//
+//  failtripstore -- a store which can't write the summary of one trip
+//
+type failtripstore struct {
+	vehstore
+	bad string // trip ID which fails
+}
+
+func (s failtripstore) writetripsummary(worker string, r tripsummary) error {
+	if r.tripid == s.bad {
+		return errors.New("injected failure")
+	}
+	return s.vehstore.writetripsummary(worker, r)
+}
+
+//
+//  checkskipbadtrip -- a trip which fails doesn't stop the others, and a trip with no events is dropped
+//
+func checkskipbadtrip(t *testing.T, store vehstore) {
+	defer func(pause time.Duration) { summarizepause = pause }(summarizepause)
+	summarizepause = 0
+	var tripids []string
+	for i := 0; i < 3; i++ {
+		tripid := GenerateRandomTripid()
+		hdr, ev := testevent(tripid, 0)
+		if err := store.appendevent(hdr, ev, usednonce{}); err != nil {
+			t.Fatal(err)
+		}
+		tripids = append(tripids, tripid)
+	}
+	empty := GenerateRandomTripid()
+	if err := store.marktrippending(empty); err != nil { // on to-do list, but no events
+		t.Fatal(err)
+	}
+	agetodo(t, store)
+	n, err := dosummarize(failtripstore{store, tripids[0]}, "test", false)
+	if n != 2 || err == nil {
+		t.Errorf("Summarized %d trips, err %v; expected 2, and the failure", n, err)
+	}
+	for _, tripid := range tripids[1:] {
+		if _, err := store.loadtripsummary(tripid); err != nil {
+			t.Errorf("Trip after failed trip not summarized: %v", err)
+		}
+	}
+	//  Failed trip is still leased, for retry; the empty one is gone
+	if id, _, err := store.claimtrip("other", 60); err != errNoPendingTrip {
+		t.Errorf("To-do list: \"%s\" claimed, %v; expected nothing claimable", id, err)
+	}
+	if n, err := dosummarize(store, "test", false); n != 0 || err != nil {
+		t.Errorf("Second cycle: %d trips, err %v; expected 0, nil", n, err)
+	}
+}
+
+func TestSkipBadTrip(t *testing.T) {
+	forstores(t, checkskipbadtrip)
+}
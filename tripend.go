@@ -0,0 +1,85 @@
+//
+//  tripend -- when is a trip over?
+//
+//  A trip is over when no events have arrived for the idle time, or, for
+//  a vehicle which never stops, when it has run for the maximum trip time.
+//  Both come from the config file, with overrides by object name, and are
+//  stored with the trip's to-do entry when the trip starts. An override of
+//  0 keeps the default; a maximum trip time of -1 turns the limit off, so
+//  long-haul vehicles can run as long as they like.
+//
+package main
+
+import (
+	"fmt"
+	"path"
+)
+
+//
+//  Constants
+//
+const nomaxtrip = -1 // Maxtripsecs in config for no limit
+
+//
+//  tripendrule -- override for objects whose name matches a pattern
+//
+type tripendrule struct {
+	pattern     string // as for path.Match, such as "Motorcycle*"
+	idlesecs    int    // trip over after this long without events
+	maxtripsecs int    // summarize running trip after this long; 0 for no limit
+}
+
+//
+//  tripends -- the defaults and the overrides, first match wins
+//
+type tripends struct {
+	idlesecs    int
+	maxtripsecs int
+	rules       []tripendrule
+}
+
+func newtripends(config vdbconfig) (tripends, error) {
+	e := tripends{idlesecs: config.Trips.Idlesecs, maxtripsecs: config.Trips.Maxtripsecs}
+	if e.idlesecs <= 0 {
+		e.idlesecs = minSummarizeSecs
+	}
+	if e.maxtripsecs < 0 {
+		e.maxtripsecs = 0 // no limit
+	}
+	for _, o := range config.Trips.Objects {
+		if _, err := path.Match(o.Pattern, ""); err != nil {
+			return e, fmt.Errorf("Bad object name pattern \"%s\" in config: %s", o.Pattern, err)
+		}
+		r := tripendrule{pattern: o.Pattern, idlesecs: o.Idlesecs, maxtripsecs: o.Maxtripsecs}
+		if r.idlesecs <= 0 { // not overridden
+			r.idlesecs = e.idlesecs
+		}
+		switch {
+		case r.maxtripsecs == nomaxtrip: // limit turned off for these objects
+			r.maxtripsecs = 0
+		case r.maxtripsecs < 0:
+			return e, fmt.Errorf("Bad Maxtripsecs %d for \"%s\" in config; -1 for no limit", o.Maxtripsecs, o.Pattern)
+		case r.maxtripsecs == 0: // not overridden
+			r.maxtripsecs = e.maxtripsecs
+		}
+		e.rules = append(e.rules, r)
+	}
+	return e, nil
+}
+
+//
+//  forobject -- idle time and maximum trip time for an object
+//
+func (e tripends) forobject(object_name string) (int, int) {
+	for _, r := range e.rules {
+		if ok, _ := path.Match(r.pattern, object_name); ok {
+			return r.idlesecs, r.maxtripsecs
+		}
+	}
+	return e.idlesecs, e.maxtripsecs
+}
+
+//
+//  tripend -- the rules for this process. Set from config by initserver.
+//
+var tripend = tripends{idlesecs: minSummarizeSecs}
@@ -0,0 +1,186 @@
+//
+//  Tests for end of trip detection
+//
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+//
+//  testtripends -- end of trip rules from a config fragment
+//
+func testtripends(t *testing.T, js string) tripends {
+	config := testcfg
+	if err := json.Unmarshal([]byte(js), &config.Trips); err != nil {
+		t.Fatal(err)
+	}
+	e, err := newtripends(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestTripEnds(t *testing.T) {
+	e := testtripends(t, `{"Idlesecs": 300, "Maxtripsecs": 3600, "Objects": [
+		{"Pattern": "Motorcycle*", "Idlesecs": 7200},
+		{"Pattern": "Bus *", "Maxtripsecs": 14400},
+		{"Pattern": "Truck *", "Maxtripsecs": -1}]}`)
+	tests := []struct {
+		object_name string
+		idlesecs    int
+		maxtripsecs int
+	}{
+		{"Motorcycle 2.1", 7200, 3600},
+		{"Bus 42", 300, 14400},
+		{"Truck 7", 300, 0}, // long haul, no limit
+		{"Logging tester 0.4", 300, 3600},
+	}
+	for _, test := range tests {
+		if idle, max := e.forobject(test.object_name); idle != test.idlesecs || max != test.maxtripsecs {
+			t.Errorf("%s: idle %d, max %d, expected %d, %d", test.object_name, idle, max, test.idlesecs, test.maxtripsecs)
+		}
+	}
+	if e := testtripends(t, `{}`); e.idlesecs != minSummarizeSecs {
+		t.Errorf("Default idle time %d, expected %d", e.idlesecs, minSummarizeSecs)
+	}
+	config := testcfg
+	json.Unmarshal([]byte(`{"Objects": [{"Pattern": "Motorcycle["}]}`), &config.Trips)
+	if _, err := newtripends(config); err == nil {
+		t.Errorf("Bad pattern accepted")
+	}
+	config = testcfg
+	json.Unmarshal([]byte(`{"Objects": [{"Pattern": "Truck *", "Maxtripsecs": -5}]}`), &config.Trips)
+	if _, err := newtripends(config); err == nil {
+		t.Errorf("Bad max trip time accepted")
+	}
+}
+
+//
+//  checkobjectidle -- a trip is over after its own object's idle time
+//
+func checkobjectidle(t *testing.T, store vehstore) {
+	defer func(saved tripends) { tripend = saved }(tripend)
+	tripend = testtripends(t, `{"Objects": [{"Pattern": "Motorcycle*", "Idlesecs": 7200}]}`)
+	slow := GenerateRandomTripid()
+	hdr, ev := testevent(slow, 0)
+	hdr.Object_name = "Motorcycle 2.1"
+	mustappend(t, store, hdr, ev)
+	fast := GenerateRandomTripid()
+	hdr, ev = testevent(fast, 0)
+	mustappend(t, store, hdr, ev)
+	agetodo(t, store) // longer than the default, not the motorcycle's
+	if n, err := dosummarize(store, "test", false); n != 1 || err != nil {
+		t.Fatalf("Summarized %d trips, err %v, expected 1", n, err)
+	}
+	if _, err := store.loadtripsummary(fast); err != nil {
+		t.Errorf("Trip with default idle time not summarized: %s", err)
+	}
+	if _, err := store.loadtripsummary(slow); err == nil {
+		t.Errorf("Motorcycle trip summarized before its idle time")
+	}
+}
+
+func TestObjectIdle(t *testing.T) {
+	forstores(t, checkobjectidle)
+}
+
+//
+//  checkmaxtrip -- a trip which never goes idle is summarized after the maximum trip time
+//
+func checkmaxtrip(t *testing.T, store vehstore) {
+	defer func(saved tripends) { tripend = saved }(tripend)
+	tripend = testtripends(t, `{"Maxtripsecs": 60}`)
+	tripid := GenerateRandomTripid()
+	hdr, ev := testevent(tripid, 0)
+	mustappend(t, store, hdr, ev)
+	agetodo(t, store) // trip started an hour ago
+	hdr, ev = testevent(tripid, 1)
+	ev.Eventtype = "SLOW"
+	mustappend(t, store, hdr, ev) // and is still running
+	if id, _, err := store.pendingtrip(); id != tripid || err != nil {
+		t.Fatalf("Long trip not pending: \"%s\", %v", id, err)
+	}
+	if n, err := dosummarize(store, "test", false); n != 1 || err != nil {
+		t.Fatalf("Summarized %d trips, err %v, expected 1", n, err)
+	}
+	if r, _ := store.loadtripsummary(tripid); r.trip_status != "NOSHUTDOWN" {
+		t.Errorf("Running trip: status %s, expected NOSHUTDOWN", r.trip_status)
+	}
+	if _, _, err := store.pendingtrip(); err != errNoPendingTrip {
+		t.Errorf("Trip pending again right after summary: %v", err)
+	}
+}
+
+func TestMaxTrip(t *testing.T) {
+	forstores(t, checkmaxtrip)
+}
+
+//
+//  checkreopen -- a trip which paused longer than the idle time continues
+//
+func checkreopen(t *testing.T, store vehstore) {
+	tripid := GenerateRandomTripid()
+	hdr, ev := testevent(tripid, 0)
+	mustappend(t, store, hdr, ev)
+	agetodo(t, store) // driver parked
+	dosummarize(store, "test", false)
+	if r, _ := store.loadtripsummary(tripid); r.trip_status != "NOSHUTDOWN" {
+		t.Fatalf("Paused trip: status %s, expected NOSHUTDOWN", r.trip_status)
+	}
+	hdr, ev = testevent(tripid, 1) // and drove on
+	ev.Eventtype = "SHUTDOWN"
+	mustappend(t, store, hdr, ev)
+	if te, _ := store.loadevent(tripid, 1); te.ev.Late {
+		t.Errorf("Event continuing paused trip marked late")
+	}
+	agetodo(t, store)
+	dosummarize(store, "test", false)
+	r, _ := store.loadtripsummary(tripid)
+	if r.trip_status != "OK" || r.data_status != "OK" || r.revision != 2 || r.late_events != 0 {
+		t.Errorf("Reopened trip: status %s, data %s, revision %d, %d late events", r.trip_status, r.data_status, r.revision, r.late_events)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	forstores(t, checkreopen)
+}
+
+//
+//  checkfaultreopen -- a faulted trip split at the maximum trip time continues
+//
+func checkfaultreopen(t *testing.T, store vehstore) {
+	defer func(saved tripends) { tripend = saved }(tripend)
+	tripend = testtripends(t, `{"Maxtripsecs": 60}`)
+	tripid := GenerateRandomTripid()
+	hdr, ev := testevent(tripid, 0)
+	mustappend(t, store, hdr, ev)
+	agetodo(t, store) // trip started an hour ago
+	hdr, ev = testevent(tripid, 1)
+	ev.Eventtype = "SCRIPTFAIL"
+	mustappend(t, store, hdr, ev) // and is still running, after a fault
+	if n, err := dosummarize(store, "test", false); n != 1 || err != nil {
+		t.Fatalf("Summarized %d trips, err %v, expected 1", n, err)
+	}
+	if r, _ := store.loadtripsummary(tripid); r.trip_status != "FAULT" {
+		t.Fatalf("Running trip: status %s, expected FAULT", r.trip_status)
+	}
+	hdr, ev = testevent(tripid, 2)
+	ev.Eventtype = "SHUTDOWN"
+	mustappend(t, store, hdr, ev)
+	if te, _ := store.loadevent(tripid, 2); te.ev.Late {
+		t.Errorf("Event continuing faulted trip marked late")
+	}
+	agetodo(t, store)
+	dosummarize(store, "test", false)
+	r, _ := store.loadtripsummary(tripid)
+	if r.trip_status != "FAULT" || r.revision != 2 || r.late_events != 0 {
+		t.Errorf("Reopened faulted trip: status %s, revision %d, %d late events", r.trip_status, r.revision, r.late_events)
+	}
+}
+
+func TestFaultReopen(t *testing.T) {
+	forstores(t, checkfaultreopen)
+}
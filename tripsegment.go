@@ -0,0 +1,48 @@
+//
+//  tripsegment -- one region's part of a trip
+//
+//  The summarizer splits a trip at each region crossing. A segment runs
+//  from the first event in a region to the last one before the vehicle
+//  left, so the segments show which stretch of a route took the time
+//  and had the trouble.
+//
+package main
+
+//
+//  tripsegment -- a row of the tripsegments table
+//
+type tripsegment struct {
+	tripid      string      // ID of trip
+	seq         int32       // 0 for the starting region, then in order visited
+	region_name string      // region, on the trip's grid
+	entered     int64       // first event in region, UNIX, client time
+	exited      int64       // last event in region, UNIX, client time
+	entry_pos   slglobalpos // first event position, global
+	exit_pos    slglobalpos // last event position, global
+	distance    float64     // traveled in region, from events
+	events      int32       // events logged in region
+	faults      int32       // trouble events in region
+}
+
+//
+//  updatesegments -- add event to the current segment, or start a new one
+//
+//  leg is the distance from the previous event. A leg which crosses a
+//  region boundary counts in the region entered.
+//
+func (r *trip) updatesegments(event vehlogevent, hdr slheader, gpos slglobalpos, leg float64) {
+	n := len(r.sx.segments)
+	if n == 0 || r.sx.segments[n-1].region_name != hdr.Region.Name { // region crossing
+		r.sx.segments = append(r.sx.segments, tripsegment{tripid: event.Tripid, seq: int32(n),
+			region_name: hdr.Region.Name, entered: event.Timestamp, entry_pos: gpos})
+		n++
+	}
+	seg := &r.sx.segments[n-1]
+	seg.exited = event.Timestamp
+	seg.exit_pos = gpos
+	seg.distance += leg
+	seg.events++
+	if istrouble(event.Eventtype) {
+		seg.faults++
+	}
+}
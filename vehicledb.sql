@@ -14,15 +14,28 @@ USE vehicles;
 CREATE TABLE IF NOT EXISTS events (
     serial          INT NOT NULL,               -- client side serial number
     time            BIGINT NOT NULL,            -- UNIX timestamp, client side, not server side
+    received        BIGINT NOT NULL DEFAULT 0,  -- UNIX timestamp, server side, 0 if unknown
+    suspect         BOOLEAN NOT NULL DEFAULT FALSE, -- client timestamp far from server time
+    late            BOOLEAN NOT NULL DEFAULT FALSE, -- arrived after trip was summarized
     shard           VARCHAR(255) NOT NULL,      -- server shard
+    grid            VARCHAR(255) NOT NULL DEFAULT '', -- grid name, from config, shard, or sim host
 	owner_name      VARCHAR(255) NOT NULL,      -- name of owner
+	owner_key       CHAR(36) NOT NULL DEFAULT '', -- owner UUID, lower case
 	object_name     VARCHAR(255) NOT NULL,      -- object name
+	object_key      CHAR(36) NOT NULL DEFAULT '', -- object UUID, lower case
 	region_name     VARCHAR(255) NOT NULL,      -- name of region
 	region_corner_x   INT NOT NULL,	            -- corner of region
 	region_corner_Y   INT NOT NULL,	            -- corner of region
 	local_position_x  FLOAT NOT NULL,           -- X and Y only
 	local_position_y  FLOAT NOT NULL,           -- X and Y only
 	local_position_z  FLOAT NOT NULL DEFAULT -1.0,   -- turns out we need Z to detect falls
+	local_velocity_x  FLOAT NOT NULL DEFAULT 0,      -- velocity, region axes, meters/sec
+	local_velocity_y  FLOAT NOT NULL DEFAULT 0,
+	local_velocity_z  FLOAT NOT NULL DEFAULT 0,
+	local_rotation_x  FLOAT NOT NULL DEFAULT 0,      -- rotation quaternion, region axes, all 0 if unknown
+	local_rotation_y  FLOAT NOT NULL DEFAULT 0,
+	local_rotation_z  FLOAT NOT NULL DEFAULT 0,
+	local_rotation_s  FLOAT NOT NULL DEFAULT 0,
 	tripid          CHAR(40) NOT NULL,          -- trip ID (random unique identifier)
 	severity        TINYINT NOT NULL,           -- an enum, really
 	eventtype       VARCHAR(20) NOT NULL,       -- STARTUP, SHUTDOWN, etc.
@@ -30,7 +43,8 @@ CREATE TABLE IF NOT EXISTS events (
 	auxval          FLOAT NOT NULL,             -- some other value associated with the event type
 	INDEX(tripid),
 	UNIQUE INDEX(tripid, serial),               -- catch dups at insert time
-	INDEX(eventtype)
+	INDEX(eventtype),
+	INDEX(grid, region_name)                    -- region names are only unique within a grid
 ) ENGINE InnoDB;
 
 --
@@ -40,9 +54,11 @@ CREATE TABLE IF NOT EXISTS errorlog (
     stamp           TIMESTAMP,                  -- automatic timestamp
     owner_name      VARCHAR(255) DEFAULT NULL,  -- owner if relevant
     tripid          CHAR(40) DEFAULT NULL,      -- trip ID if relevant
+    category        VARCHAR(20) DEFAULT NULL,   -- bad_auth, bad_json, summarize, retired_key, etc.
     msg             TEXT,                       -- error message
     INDEX(owner_name),
-    INDEX(tripid)
+    INDEX(tripid),
+    INDEX(stamp)
 ) ENGINE InnoDB;
 
 --
@@ -50,7 +66,12 @@ CREATE TABLE IF NOT EXISTS errorlog (
 --  
 CREATE TABLE IF NOT EXISTS tripstodo (
     tripid          CHAR(40) NOT NULL PRIMARY KEY,      -- trip ID 
-    stamp           TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP -- last update
+    stamp           TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP, -- last update
+    created         TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, -- trip start, or last summary of a running trip
+    idle_secs       INT NOT NULL DEFAULT 120,           -- trip over after no events for this long
+    max_secs        INT NOT NULL DEFAULT 0,             -- summarize running trip after this long, 0 for no limit
+    lease_owner     VARCHAR(255) DEFAULT NULL,          -- summarizer working on this trip
+    lease_expires   TIMESTAMP NULL DEFAULT NULL         -- when another summarizer may take it
 ) ENGINE InnoDB;
 
 --
@@ -61,8 +82,11 @@ CREATE TABLE IF NOT EXISTS trips (
     elapsed         INT NOT NULL,               -- elapsed time
     tripid          CHAR(40) NOT NULL,          -- ID of trip
     owner_name      VARCHAR(255) NOT NULL,      -- name of owner
-    shard          VARCHAR(255) NOT NULL,       -- grid name
+    owner_key       CHAR(36) NOT NULL DEFAULT '', -- owner UUID, empty for trips logged before keys were
+    shard          VARCHAR(255) NOT NULL,       -- server shard
+    grid            VARCHAR(255) NOT NULL DEFAULT '', -- grid name
 	object_name     VARCHAR(255) NOT NULL,      -- object name
+	object_key      CHAR(36) NOT NULL DEFAULT '', -- object UUID, empty for trips logged before keys were
 	driver_key      CHAR(36) NOT NULL,          -- driver avatar key if available
 	driver_name     VARCHAR(255) NOT NULL,      -- name of driver
 	driver_display_name VARCHAR(255) NOT NULL,  -- display name of driver
@@ -70,6 +94,7 @@ CREATE TABLE IF NOT EXISTS trips (
 	distance        FLOAT NOT NULL,             -- distance traveled, from client
 	regions_crossed INT NOT NULL,               -- number of region crossings
 	trip_status     ENUM("OK","FAULT","NOSHUTDOWN"), -- how did trip end?
+	ended_shutdown  BOOLEAN NOT NULL DEFAULT FALSE, -- last event was SHUTDOWN; later events are late
 	data_status     ENUM("OK","MISSING","INCONSISTENT"), -- data problems  
 	severity        TINYINT NOT NULL,           -- worst severity level 
 	start_region_name VARCHAR(255) NOT NULL,    -- starting region
@@ -78,10 +103,155 @@ CREATE TABLE IF NOT EXISTS trips (
 	min_pos_y       FLOAT NOT NULL,             -- min Y value, global
 	max_pos_x       FLOAT NOT NULL,             -- max X value, global
     max_pos_y       FLOAT NOT NULL,             -- max Y value, global
+    min_pos_z       FLOAT NOT NULL DEFAULT -1.0, -- min altitude, -1 if unknown
+    max_pos_z       FLOAT NOT NULL DEFAULT -1.0, -- max altitude, -1 if unknown
     last_eventtypes TEXT,                       -- last N event types recorded
 	msg             TEXT,                       -- message if any
+	clock_skew      INT NOT NULL DEFAULT 0,     -- server time minus client time, median, seconds
+	suspect_events  INT NOT NULL DEFAULT 0,     -- events with suspect timestamps
+	late_events     INT NOT NULL DEFAULT 0,     -- events which arrived after trip was first summarized
+	max_speed       FLOAT NOT NULL DEFAULT 0,   -- fastest speed sent with an event, meters/sec
+	avg_speed       FLOAT NOT NULL DEFAULT 0,   -- mean of speeds sent with events, meters/sec
+	heading_change  FLOAT NOT NULL DEFAULT 0,   -- total turning, degrees
+	flips           INT NOT NULL DEFAULT 0,     -- times vehicle turned upside down
+	spins           INT NOT NULL DEFAULT 0,     -- times vehicle spun out
+	revision        INT NOT NULL DEFAULT 1,     -- times trip has been summarized
+	recomputed      TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, -- when last summarized
 	INDEX(driver_name),
 	INDEX(trip_status),
 	INDEX(driver_key),
+	INDEX(grid),
+	INDEX(owner_key),
+	INDEX(object_key),
 	UNIQUE INDEX(tripid)
 ) ENGINE InnoDB;
+
+--
+--  tripsegments -- one row per region visited on a trip
+--
+CREATE TABLE IF NOT EXISTS tripsegments (
+    tripid          CHAR(40) NOT NULL,          -- ID of trip
+    seq             INT NOT NULL,               -- 0 for the starting region, then in order visited
+    region_name     VARCHAR(255) NOT NULL,      -- region, on the trip's grid
+    entered         BIGINT NOT NULL,            -- first event in region, UNIX, client time
+    exited          BIGINT NOT NULL,            -- last event in region, UNIX, client time
+    entry_pos_x     FLOAT NOT NULL,             -- first event position, global
+    entry_pos_y     FLOAT NOT NULL,
+    exit_pos_x      FLOAT NOT NULL,             -- last event position, global
+    exit_pos_y      FLOAT NOT NULL,
+    entry_pos_z     FLOAT NOT NULL DEFAULT -1.0, -- altitudes, -1 if unknown
+    exit_pos_z      FLOAT NOT NULL DEFAULT -1.0,
+    distance        FLOAT NOT NULL,             -- traveled in region, from events
+    events          INT NOT NULL,               -- events logged in region
+    faults          INT NOT NULL,               -- trouble events in region
+    PRIMARY KEY(tripid, seq),
+    INDEX(region_name)
+) ENGINE InnoDB;
+
+--
+--  crossings -- region crossings, from CROSSSPEED and CROSSEND events
+--
+--  A boundary is the pair of region corners either side of it, lower corner first.
+--
+CREATE TABLE IF NOT EXISTS crossings (
+    tripid          CHAR(40) NOT NULL,          -- ID of trip
+    seq             INT NOT NULL,               -- 0 for the first crossing of the trip, then in order
+    grid            VARCHAR(255) NOT NULL,      -- grid name
+    region_a_name   VARCHAR(255) NOT NULL,      -- region on one side of the boundary
+    region_a_x      INT NOT NULL,               -- its corner
+    region_a_y      INT NOT NULL,
+    region_b_name   VARCHAR(255) NOT NULL,      -- region on the other side
+    region_b_x      INT NOT NULL,               -- its corner
+    region_b_y      INT NOT NULL,
+    stamp           BIGINT NOT NULL,            -- CROSSSPEED time, UNIX, client time
+    speed           FLOAT NOT NULL,             -- at crossing, meters/sec
+    duration        FLOAT NOT NULL,             -- time the crossing took, secs; 0 if never completed
+    pos_error       FLOAT NOT NULL,             -- how far distance moved during crossing is off from that expected at crossing speed
+    complete        BOOLEAN NOT NULL,           -- CROSSEND received
+    PRIMARY KEY(tripid, seq),
+    INDEX(grid, region_a_x, region_a_y, region_b_x, region_b_y)
+) ENGINE InnoDB;
+
+--
+--  falls -- sudden altitude changes between events
+--
+CREATE TABLE IF NOT EXISTS falls (
+    tripid          CHAR(40) NOT NULL,          -- ID of trip
+    seq             INT NOT NULL,               -- 0 for the first incident of the trip, then in order
+    grid            VARCHAR(255) NOT NULL,      -- grid name
+    region_name     VARCHAR(255) NOT NULL,      -- region where it ended
+    serial          INT NOT NULL,               -- serial number of event after the change
+    stamp           BIGINT NOT NULL,            -- time of that event, UNIX, client time
+    kind            ENUM("DROP","JUMP"),        -- fell, or rose
+    from_z          FLOAT NOT NULL,             -- altitude at previous event
+    to_z            FLOAT NOT NULL,             -- altitude after
+    pos_x           FLOAT NOT NULL,             -- position after, global
+    pos_y           FLOAT NOT NULL,
+    near_crossing   BOOLEAN NOT NULL,           -- region changed between the events, or one was a crossing event
+    PRIMARY KEY(tripid, seq),
+    INDEX(grid, region_name)
+) ENGINE InnoDB;
+
+--
+--  nonces -- nonces of recently signed messages, to reject replays
+--
+CREATE TABLE IF NOT EXISTS nonces (
+    key_name        VARCHAR(255) NOT NULL,      -- auth key which signed the message
+    nonce           VARCHAR(64) NOT NULL,       -- X-Authtoken-Nonce
+    stamp           BIGINT NOT NULL,            -- X-Authtoken-Time, UNIX; row deleted once too old to accept
+    UNIQUE INDEX(key_name, nonce),              -- a nonce is used once
+    INDEX(stamp)
+) ENGINE InnoDB;
+
+--
+--  Upgrading an existing database. Run the statements for each change
+--  made since the database was created.
+--
+--  errorlog category:
+--    ALTER TABLE errorlog ADD COLUMN category VARCHAR(20) DEFAULT NULL AFTER tripid, ADD INDEX(stamp);
+--
+--  server receive time and clock skew:
+--    ALTER TABLE events ADD COLUMN received BIGINT NOT NULL DEFAULT 0 AFTER time, ADD COLUMN suspect BOOLEAN NOT NULL DEFAULT FALSE AFTER received;
+--    ALTER TABLE trips ADD COLUMN clock_skew INT NOT NULL DEFAULT 0 AFTER msg, ADD COLUMN suspect_events INT NOT NULL DEFAULT 0 AFTER clock_skew;
+--
+--  grid:
+--    ALTER TABLE events ADD COLUMN grid VARCHAR(255) NOT NULL DEFAULT '' AFTER shard, ADD INDEX(grid, region_name);
+--    ALTER TABLE trips ADD COLUMN grid VARCHAR(255) NOT NULL DEFAULT '' AFTER shard, ADD INDEX(grid);
+--    UPDATE events SET grid = shard WHERE grid = '';
+--    UPDATE trips SET grid = shard WHERE grid = '';
+--
+--  summarizer leases:
+--    ALTER TABLE tripstodo ADD COLUMN lease_owner VARCHAR(255) DEFAULT NULL, ADD COLUMN lease_expires TIMESTAMP NULL DEFAULT NULL;
+--
+--  late events and trip revisions:
+--    ALTER TABLE events ADD COLUMN late BOOLEAN NOT NULL DEFAULT FALSE AFTER suspect;
+--    ALTER TABLE trips ADD COLUMN late_events INT NOT NULL DEFAULT 0 AFTER suspect_events, ADD COLUMN revision INT NOT NULL DEFAULT 1 AFTER late_events, ADD COLUMN recomputed TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP AFTER revision;
+--
+--  configurable end of trip:
+--    ALTER TABLE tripstodo ADD COLUMN created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP AFTER stamp, ADD COLUMN idle_secs INT NOT NULL DEFAULT 120 AFTER created, ADD COLUMN max_secs INT NOT NULL DEFAULT 0 AFTER idle_secs;
+--
+--  trip segments:
+--    Run the CREATE TABLE for tripsegments above, then "vehiclelogserver rebuild -all" to fill it in for old trips.
+--
+--  region crossings:
+--    Run the CREATE TABLE for crossings above, then "vehiclelogserver rebuild -all" to fill it in for old trips.
+--
+--  altitude and falls:
+--    ALTER TABLE trips ADD COLUMN min_pos_z FLOAT NOT NULL DEFAULT -1.0 AFTER max_pos_y, ADD COLUMN max_pos_z FLOAT NOT NULL DEFAULT -1.0 AFTER min_pos_z;
+--    ALTER TABLE tripsegments ADD COLUMN entry_pos_z FLOAT NOT NULL DEFAULT -1.0 AFTER exit_pos_y, ADD COLUMN exit_pos_z FLOAT NOT NULL DEFAULT -1.0 AFTER entry_pos_z;
+--    Run the CREATE TABLE for falls above, then "vehiclelogserver rebuild -all".
+--
+--  velocity and rotation:
+--    ALTER TABLE events ADD COLUMN local_velocity_x FLOAT NOT NULL DEFAULT 0 AFTER local_position_z, ADD COLUMN local_velocity_y FLOAT NOT NULL DEFAULT 0 AFTER local_velocity_x, ADD COLUMN local_velocity_z FLOAT NOT NULL DEFAULT 0 AFTER local_velocity_y, ADD COLUMN local_rotation_x FLOAT NOT NULL DEFAULT 0 AFTER local_velocity_z, ADD COLUMN local_rotation_y FLOAT NOT NULL DEFAULT 0 AFTER local_rotation_x, ADD COLUMN local_rotation_z FLOAT NOT NULL DEFAULT 0 AFTER local_rotation_y, ADD COLUMN local_rotation_s FLOAT NOT NULL DEFAULT 0 AFTER local_rotation_z;
+--    ALTER TABLE trips ADD COLUMN max_speed FLOAT NOT NULL DEFAULT 0 AFTER late_events, ADD COLUMN avg_speed FLOAT NOT NULL DEFAULT 0 AFTER max_speed, ADD COLUMN heading_change FLOAT NOT NULL DEFAULT 0 AFTER avg_speed, ADD COLUMN flips INT NOT NULL DEFAULT 0 AFTER heading_change, ADD COLUMN spins INT NOT NULL DEFAULT 0 AFTER flips;
+--
+--  owner and object keys:
+--    ALTER TABLE events ADD COLUMN owner_key CHAR(36) NOT NULL DEFAULT '' AFTER owner_name, ADD COLUMN object_key CHAR(36) NOT NULL DEFAULT '' AFTER object_name;
+--    ALTER TABLE trips ADD COLUMN owner_key CHAR(36) NOT NULL DEFAULT '' AFTER owner_name, ADD COLUMN object_key CHAR(36) NOT NULL DEFAULT '' AFTER object_name, ADD INDEX(owner_key), ADD INDEX(object_key);
+--
+--  replay protection:
+--    Run the CREATE TABLE for nonces above.
+--
+--  trips which ended with SHUTDOWN:
+--    ALTER TABLE trips ADD COLUMN ended_shutdown BOOLEAN NOT NULL DEFAULT FALSE AFTER trip_status;
+--    UPDATE trips SET ended_shutdown = TRUE WHERE last_eventtypes LIKE '%SHUTDOWN';
@@ -7,11 +7,21 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/fcgi"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 //
@@ -21,21 +31,50 @@ import (
 //
 var configloc string = "~/keys/vehicledbconf.json"
 
+const defaultshutdownsecs = 60 // default time allowed to drain requests at shutdown
+const defaultmaxbody = 16384   // default limit on request body size, bytes
+
+//
+//  Shutdown flag. Set on SIGTERM in standalone mode, so that a summarize
+//  cycle in progress stops after the current trip.
+//
+var shuttingdown int32
+
+func isshuttingdown() bool {
+	return atomic.LoadInt32(&shuttingdown) != 0
+}
+
 //
 //  initialization
 //
 func initdb(cfile string, sv *FastCGIServer) error {
 	//  Read the config file into the server object
-	const mysqloptions = "parseTime=true" // makes TIMESTAMP -> time.Time conversions work
+	config, err := readconfig(cfile)
+	if err != nil {
+		return err
+	}
+	return initserver(config, sv)
+}
+
+//
+//  initserver -- set up server from a config, read from a file or built by a test
+//
+func initserver(config vdbconfig, sv *FastCGIServer) error {
 	var err error
-	sv.config, err = readconfig(cfile)
+	sv.config = config
+	errorlimit = newerrorlimiter(config.Errorlog.Maxperowner, config.Errorlog.Windowsecs)
+	forwardedfor = strings.TrimSpace(config.Errorlog.Forwardedfor)
+	skewlimit = newskewlimits(config.Clock.Maxfuturesecs, config.Clock.Maxpastsecs)
+	nonces = newnoncewindow(config.Auth.Maxagesecs)
+	tripend, err = newtripends(config)
 	if err != nil {
 		return err
 	}
-	//  Set database parameters (does not actually do an open in Go, so it won't fail)
-	s := fmt.Sprintf("%s:%s@tcp(%s)/%s?%s",
-		sv.config.Mysql.User, sv.config.Mysql.Password, sv.config.Mysql.Domain, sv.config.Mysql.Database, mysqloptions)
-	sv.db, err = sql.Open("mysql", s)
+	summarizelease = defaultleasesecs
+	if config.Summarizer.Leasesecs > 0 {
+		summarizelease = config.Summarizer.Leasesecs
+	}
+	sv.store, err = openstore(sv.config) // MySQL, SQLite, or memory
 	if err != nil {
 		return err
 	}
@@ -44,8 +83,9 @@ func initdb(cfile string, sv *FastCGIServer) error {
 
 //  Instance of a server.
 type FastCGIServer struct {
-	config vdbconfig // the configuration
-	db     *sql.DB   // database
+	config     vdbconfig      // the configuration
+	store      vehstore       // event and trip storage
+	summarizer *summaryworker // background summarizer, nil if run elsewhere
 }
 
 //
@@ -73,25 +113,194 @@ func dumprequest(sv FastCGIServer, w http.ResponseWriter, req *http.Request, bod
 	w.Write([]byte("\n"))
 }
 
+//
+//  readbody -- read entire request body, up to maxbody bytes
+//
+//  Returns the HTTP status to send if the body can't be used.
+//
+func readbody(req *http.Request, maxbody int64) ([]byte, int, error) {
+	if req.ContentLength > maxbody { // don't bother reading it
+		return nil, http.StatusRequestEntityTooLarge,
+			fmt.Errorf("Request body of %d bytes is over the limit of %d bytes", req.ContentLength, maxbody)
+	}
+	bodycontent, err := ioutil.ReadAll(io.LimitReader(req.Body, maxbody+1)) // one extra byte detects oversize
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("Error reading request body after %d bytes: %s", len(bodycontent), err)
+	}
+	if int64(len(bodycontent)) > maxbody {
+		return nil, http.StatusRequestEntityTooLarge,
+			fmt.Errorf("Request body is over the limit of %d bytes", maxbody)
+	}
+	return bodycontent, http.StatusOK, nil
+}
+
 //
 //  Called for each request
 //
 func (sv FastCGIServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	body := make([]byte, 5000) // buffer for body, which should not be too big
-	if req.Body != nil {
-		len, _ := req.Body.Read(body)          // body of HTTP request
-		bodycontent := body[0:len]             // take correct part of buffer
-		Handlerequest(sv, w, bodycontent, req) // handle request
+	if req.Body == nil {
+		writereply(w, http.StatusBadRequest, ingestresponse{Status: statusbadjson, Received: time.Now().Unix(), Msg: "Request has no body"})
+		return
+	}
+	maxbody := sv.config.Server.Maxbody
+	if maxbody <= 0 {
+		maxbody = defaultmaxbody
+	}
+	bodycontent, status, err := readbody(req, maxbody) // body of HTTP request
+	if err != nil {
+		writereply(w, status, ingestresponse{Status: statusbadjson, Received: time.Now().Unix(), Msg: err.Error()})
+		return
 	}
+	Handlerequest(sv, w, bodycontent, req) // handle request
 }
 
-//  Run FCGI server
+//
+//  servehttp -- run as a standalone HTTP or HTTPS server
+//
+//  On SIGTERM or SIGINT, stops accepting connections and waits for
+//  requests in progress, and any summarization cycle, to finish.
+//
+func servehttp(sv *FastCGIServer, addr string, certfile string, keyfile string) error {
+	srv := &http.Server{Addr: addr, Handler: sv}
+	done := make(chan error, 1)
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-sigs
+		log.Printf("Received %s, shutting down.", sig)
+		atomic.StoreInt32(&shuttingdown, 1) // no new summarize work
+		secs := sv.config.Server.Shutdownsecs
+		if secs <= 0 {
+			secs = defaultshutdownsecs
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(secs)*time.Second)
+		defer cancel()
+		err := srv.Shutdown(ctx) // drain in-flight requests
+		if sv.summarizer != nil {
+			sv.summarizer.stop()
+		}
+		done <- err
+	}()
+	var err error
+	if certfile != "" || keyfile != "" {
+		log.Printf("Listening for HTTPS on %s", addr)
+		err = srv.ListenAndServeTLS(certfile, keyfile)
+	} else {
+		log.Printf("Listening for HTTP on %s", addr)
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		return err // failed to start
+	}
+	return <-done // result of shutdown
+}
+
+//
+//  servesummarize -- run only the summarizer, until SIGTERM or SIGINT
+//
+//  For FastCGI hosting, where server processes come and go with the load.
+//
+func servesummarize(sv *FastCGIServer) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	log.Printf("Summarizing every %s", sv.summarizer.interval)
+	sv.summarizer.runnow() // catch up at startup
+	sig := <-sigs
+	log.Printf("Received %s, shutting down.", sig)
+	atomic.StoreInt32(&shuttingdown, 1) // stop after current trip
+	sv.summarizer.stop()
+	return nil
+}
+
+//
+//  serveadmin -- listen for admin requests. Runs as a goroutine.
+//
+func serveadmin(sv *FastCGIServer, addr string) {
+	log.Printf("Admin requests on %s", addr)
+	err := http.ListenAndServe(addr, adminhandler(sv.summarizer))
+	log.Printf("Admin listener failed: %s", err) // server keeps running without it
+}
+
+//
+//  checkadmin -- is there one summarizer for the admin listener to control?
+//
+//  Under FastCGI the host starts as many server processes as it likes,
+//  each with its own summarizer, and only one could bind the admin
+//  address. Admin requests then go to a "-mode summarize" process instead.
+//
+func checkadmin(mode string, adminlisten string, external bool) error {
+	if (mode == "" || mode == "fcgi") && adminlisten != "" && !external {
+		return errors.New("Adminlisten in fcgi mode needs Summarizer.External, and a \"-mode summarize\" process to take admin requests")
+	}
+	return nil
+}
+
+//  Run FCGI or standalone server, or an admin command
 func main() {
+	commands := map[string]func([]string) error{
+		"rebuild":   rebuildcommand,   // recompute trip summaries
+		"crossings": crossingscommand, // report on region boundaries
+		"falls":     fallscommand,     // report on falls and jumps
+		"regions":   regionscommand,   // report on activity by region
+		"errors":    errorscommand,    // list recent errorlog entries
+	}
+	if len(os.Args) > 1 && commands[os.Args[1]] != nil {
+		if err := commands[os.Args[1]](os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	cfile := flag.String("config", configloc, "configuration file")
+	mode := flag.String("mode", "", "server mode, \"fcgi\", \"http\", or \"summarize\" (default from config, else fcgi)")
+	listen := flag.String("listen", "", "address for http mode, such as \":8080\"")
+	certfile := flag.String("cert", "", "TLS certificate file for http mode (enables HTTPS)")
+	keyfile := flag.String("key", "", "TLS private key file for http mode")
+	flag.Parse()
 	fmt.Println("Starting server...")
 	sv := new(FastCGIServer)
-	err := initdb(configloc, sv)
+	err := initdb(*cfile, sv)
 	if err != nil {
 		log.Fatal(err) // initialization failed, cannot start
 	}
-	fcgi.Serve(nil, sv)
+	//  Command line overrides config file
+	cf := sv.config.Server
+	if *mode != "" {
+		cf.Mode = *mode
+	}
+	if *listen != "" {
+		cf.Listen = *listen
+	}
+	if *certfile != "" {
+		cf.Certfile = *certfile
+	}
+	if *keyfile != "" {
+		cf.Keyfile = *keyfile
+	}
+	if err := checkadmin(cf.Mode, cf.Adminlisten, sv.config.Summarizer.External); err != nil {
+		log.Fatal(err)
+	}
+	//  Background summarizer, unless a separate process does it
+	if cf.Mode == "summarize" || !sv.config.Summarizer.External {
+		sv.summarizer = newsummaryworker(sv.store, sv.config.Summarizer.Intervalsecs, false)
+		go sv.summarizer.run()
+		if cf.Adminlisten != "" { // not in fcgi mode, per checkadmin
+			go serveadmin(sv, cf.Adminlisten)
+		}
+	}
+	switch cf.Mode {
+	case "", "fcgi":
+		err = fcgi.Serve(nil, sv)
+	case "http":
+		if cf.Listen == "" {
+			log.Fatal("No listen address for http mode")
+		}
+		err = servehttp(sv, cf.Listen, cf.Certfile, cf.Keyfile)
+	case "summarize":
+		err = servesummarize(sv)
+	default:
+		log.Fatalf("Unknown server mode \"%s\"", cf.Mode)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 }
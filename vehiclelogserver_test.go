@@ -7,14 +7,21 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha1" // cryptograpically weak, but SL still uses it
+	"database/sql/driver"
 	"encoding/csv"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
@@ -58,6 +65,34 @@ var testsv *FastCGIServer     // the server object
 var verbose = false           // extra debug msgs if true
 var testtokenname = "MAR2018" // use this named crypto token for testing
 
+//
+//  Test configuration. Injected into the server instead of reading
+//  ~/keys/vehicledbconf.json, so the tests need no secrets or database.
+//  Set VEHICLEDBCONF to a real config file to also check against SL-computed hashes.
+//
+var testsecret = "testsecret-not-for-production" // signing secret for tests only
+var testcfg = testconfig()
+
+func testconfig() vdbconfig {
+	var config vdbconfig
+	config.Store = "memory"
+	config.Auth.Legacy = true // test data is old-format messages, signed over the body alone
+	config.Authkey = map[string]authkey{testtokenname: {Versions: []authversion{{Secret: testsecret}}, Enabled: true}}
+	return config
+}
+
+//
+//  newtestserver -- a server with the test config and an empty memory store
+//
+func newtestserver(t *testing.T) *FastCGIServer {
+	sv := new(FastCGIServer)
+	err := initserver(testcfg, sv)
+	if err != nil {
+		t.Fatalf("Test server setup failed: %s", err)
+	}
+	return sv
+}
+
 //  Test data row - a string in JSON format, and a HTTP header
 
 type testrow struct {
@@ -81,8 +116,8 @@ func SignLogMsg(testjson []byte, hdr http.Header, tokenname string) { // sign lo
 	//  Build properly signed test JSON
 	var testkey []string
 	testkey = append(testkey, tokenname)
-	testheader1["X-Authtoken-Name"] = testkey
-	token := testsv.config.Authkey[testkey[0]]
+	hdr["X-Authtoken-Name"] = testkey
+	token := testcfg.Authkey[testkey[0]].Versions[0].Secret
 	hash := Hashwithtoken([]byte(token[:]), testjson)
 	var hashes []string
 	hashes = append(hashes, string(hash))
@@ -95,7 +130,7 @@ func SignLogMsg(testjson []byte, hdr http.Header, tokenname string) { // sign lo
 func ReadTabTestData(filename string) ([]testrow, error) {
 	rows := make([]testrow, 0) // rows of test data
 	// read data from tab-delimited file
-	csvFile, err := os.Open("./testdata.txt")
+	csvFile, err := os.Open(filename)
 	if err != nil {
 		return rows, err
 	}
@@ -138,6 +173,8 @@ func ReadTabTestData(filename string) ([]testrow, error) {
 		ritem.hdr["X-Secondlife-Shard"] = append(make([]string, 0), row[2])
 		ritem.hdr["X-Secondlife-Owner-Name"] = append(make([]string, 0), row[3])
 		ritem.hdr["X-Secondlife-Object-Name"] = append(make([]string, 0), row[4])
+		ritem.hdr["X-Secondlife-Owner-Key"] = testheader1["X-Secondlife-Owner-Key"] // not in test data
+		ritem.hdr["X-Secondlife-Object-Key"] = testheader1["X-Secondlife-Object-Key"]
 		ritem.hdr["X-Secondlife-Region"] = append(make([]string, 0), fmt.Sprintf("%s (%s,%s)", row[5], row[6], row[7]))
 		ritem.hdr["X-Secondlife-Local-Position"] = append(make([]string, 0), fmt.Sprintf("(%s,%s,0.0)", row[8], row[9]))
 		//  Adjust test data
@@ -161,14 +198,8 @@ func ReadTabTestData(filename string) ([]testrow, error) {
 }
 
 func TestInit(t *testing.T) {
-	//  Reads the config file into variable "config".
-	testsv = new(FastCGIServer)
-	err := initdb("~/keys/vehicledbconf.json", testsv)
-	if err != nil {
-		testsv = nil
-		t.Errorf(err.Error())
-		return
-	}
+	//  Sets up the shared test server from the injected test config.
+	testsv = newtestserver(t)
 	fmt.Printf("Config: %s\n", testsv.config)
 }
 
@@ -180,17 +211,38 @@ func TestSHA1Compat(t *testing.T) {
 	hash := sha1.Sum([]byte(t1))                            // compute hash as binary bytes
 	hashhex := hex.EncodeToString(hash[:])                  // convert to hex to match SL
 	if t1hash != hashhex {
-		t.Errorf(fmt.Sprintf("Input: \"%s\" Hash result: \"%s\".  Expected \"%s\".", t1, hashhex, t1hash)) // ***TEMP***
+		t.Errorf("Input: \"%s\" Hash result: \"%s\".  Expected \"%s\".", t1, hashhex, t1hash) // ***TEMP***
 	}
 	fmt.Printf("Go SHA1 result matches LSL result.\n")
 }
 
 func TestTokenValidation(t *testing.T) {
-	if testsv == nil {
-		t.Errorf("Config file test failed, can't do next tests.")
-		return
+	hash := Hashwithtoken([]byte(testsecret), testjson2)
+	_, err := Validateauthtoken(testjson2, testtokenname, hash, testcfg)
+	if err != nil {
+		t.Errorf("Valid signature rejected: %s", err)
 	}
-	token := testsv.config.Authkey[tokenname]
+	_, err = Validateauthtoken(append([]byte(" "), testjson2...), testtokenname, hash, testcfg)
+	if err == nil {
+		t.Errorf("Altered message passed validation")
+	}
+	_, err = Validateauthtoken(testjson2, "NOSUCHKEY", hash, testcfg)
+	if err == nil {
+		t.Errorf("Unknown token name passed validation")
+	}
+}
+
+func TestSLTokenCompat(t *testing.T) {
+	//  Needs the real MAR2018 secret, which is not in the repository.
+	cfile := os.Getenv("VEHICLEDBCONF")
+	if cfile == "" {
+		t.Skip("VEHICLEDBCONF not set, skipping check against SL-computed hash")
+	}
+	config, err := readconfig(cfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := config.Authkey[tokenname].Versions[0].Secret // the only version, for a plain secret
 	hash := Hashwithtoken([]byte(token[:]), testjson2)
 	if hash != testjson2hash {
 		fmt.Printf("Expected: \"%s\".  Calculated hash: \"%s\"\n", testjson2hash, hash)
@@ -208,41 +260,383 @@ func TestEventLog(t *testing.T) {
 	tripid := GenerateRandomTripid()
 	testjson := []byte(strings.Replace(testjson1, "TRIPID", tripid, 1)) // fill in a new trip ID
 	//  Build properly signed test JSON
-	var testkey []string
-	testkey = append(testkey, "MAR2018")
-	testheader1["X-Authtoken-Name"] = testkey
-	token := testsv.config.Authkey[testkey[0]]
-	hash := Hashwithtoken([]byte(token[:]), testjson)
-	var hashes []string
-	hashes = append(hashes, string(hash))
 	SignLogMsg(testjson, testheader1, testtokenname)
-	err := Addevent(testjson, testheader1, testsv.config, testsv.db) // call with no database
+	_, err := Addevent(testjson, testheader1, testsv.config, testsv.store)
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err)
+	}
+	events, err := testsv.store.tripevents(tripid)
+	if err != nil || len(events) != 1 {
+		t.Errorf("Event not stored: %d events, err %v", len(events), err)
 	}
 }
 
-func TestEventLogFromFile(t *testing.T) {
-	var testfile = "testfile.txt" // tab-delimited data from real vehicle run
+//
+//  replaytestdata -- send the live data in testdata.txt through Addevent
+//
+//  Returns the trip ID used.
+//
+func replaytestdata(t *testing.T, sv *FastCGIServer) string {
+	var testfile = "testdata.txt" // tab-delimited data from real vehicle run
 	rows, err := ReadTabTestData(testfile)
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Fatal(err)
+	}
+	if len(rows) == 0 {
+		t.Fatalf("No test data in %s", testfile)
 	}
+	var tripid string
+	defer func() { servernow = time.Now }()
 	for i := range rows {
 		row := rows[i] // get row of data
-		err := Addevent(row.json, row.hdr, testsv.config, testsv.db)
+		ev, _ := Parsevehevent(row.json)
+		tripid = ev.Tripid
+		servernow = func() time.Time { return time.Unix(ev.Timestamp+2, 0) } // received as sent, in 2018
+		_, err := Addevent(row.json, row.hdr, sv.config, sv.store)
 		if err != nil {
-			t.Errorf(err.Error())
-			return
+			t.Fatal(err)
 		}
 	}
+	return tripid
+}
+
+//
+//  agetodo -- make everything on the to-do list old enough to summarize
+//
+func agetodo(t *testing.T, store vehstore) {
+	switch s := store.(type) {
+	case *memstore:
+		s.mu.Lock()
+		for tripid, td := range s.todo {
+			td.stamp = td.stamp.Add(-time.Hour)
+			td.created = td.created.Add(-time.Hour)
+			s.todo[tripid] = td
+		}
+		s.mu.Unlock()
+	case *sqlstore:
+		_, err := s.db.Exec("UPDATE tripstodo SET stamp = datetime('now', '-1 hour'), created = datetime('now', '-1 hour')")
+		if err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatalf("Don't know how to age to-do list for %T", store)
+	}
+}
+
+//
+//  checktestsummary -- check summary of the trip in testdata.txt
+//
+func checktestsummary(t *testing.T, r tripsummary) {
+	if r.regions_crossed != 109 {
+		t.Errorf("regions_crossed: got %d, expected 109", r.regions_crossed)
+	}
+	if math.Abs(r.distance-21.2551) > 0.001 {
+		t.Errorf("distance: got %f, expected 21.2551", r.distance)
+	}
+	if r.grid != "Production" {
+		t.Errorf("grid: got %s, expected Production", r.grid)
+	}
+	if r.trip_status != "OK" {
+		t.Errorf("trip_status: got %s, expected OK", r.trip_status)
+	}
+	if r.data_status != "OK" {
+		t.Errorf("data_status: got %s, expected OK", r.data_status)
+	}
+	if r.elapsed != 2966 {
+		t.Errorf("elapsed: got %d, expected 2966", r.elapsed)
+	}
+	if r.clock_skew != 2 || r.suspect_events != 0 {
+		t.Errorf("clock: got skew %d, %d suspect events, expected 2, 0", r.clock_skew, r.suspect_events)
+	}
+	if r.start_region_name != "Neumoegen" || r.end_region_name != "Neumoegen" {
+		t.Errorf("regions: got %s to %s, expected Neumoegen to Neumoegen", r.start_region_name, r.end_region_name)
+	}
+	if r.owner_name != "animats Resident" || r.object_name != "Double region crosser 1.03" {
+		t.Errorf("owner/object: got \"%s\" \"%s\"", r.owner_name, r.object_name)
+	}
+	if r.driver_name != "animats Resident" || r.driver_display_name != "Joe Magarac" {
+		t.Errorf("driver: got \"%s\" \"%s\"", r.driver_name, r.driver_display_name)
+	}
+	if len(r.last_eventtypes) != keeplasteventtypes || r.last_eventtypes[keeplasteventtypes-1] != "SHUTDOWN" {
+		t.Errorf("last_eventtypes: got %v", r.last_eventtypes)
+	}
+}
+
+//
+//  checktestsegments -- check segments of the trip in testdata.txt
+//
+func checktestsegments(t *testing.T, store vehstore, r tripsummary) {
+	segments, err := store.tripsegments(r.tripid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != int(r.regions_crossed) {
+		t.Fatalf("Got %d segments, expected one per region crossed, %d", len(segments), r.regions_crossed)
+	}
+	var events, faults int32
+	for i, seg := range segments {
+		if seg.seq != int32(i) || seg.tripid != r.tripid || seg.exited < seg.entered {
+			t.Errorf("Segment %d: seq %d, trip %s, times %d to %d", i, seg.seq, seg.tripid, seg.entered, seg.exited)
+		}
+		if i > 0 && (seg.region_name == segments[i-1].region_name || seg.entered < segments[i-1].exited) {
+			t.Errorf("Segment %d in %s doesn't follow segment in %s", i, seg.region_name, segments[i-1].region_name)
+		}
+		events += seg.events
+		faults += seg.faults
+	}
+	if segments[0].region_name != r.start_region_name || segments[len(segments)-1].region_name != r.end_region_name {
+		t.Errorf("Segments run from %s to %s, trip from %s to %s", segments[0].region_name,
+			segments[len(segments)-1].region_name, r.start_region_name, r.end_region_name)
+	}
+	if events != 243 || faults != 0 {
+		t.Errorf("Segments have %d events, %d faults, expected 243, 0", events, faults)
+	}
+}
+
+//
+//  summarizetestdata -- replay testdata.txt into a store, summarize, and check the result
+//
+func summarizetestdata(t *testing.T, sv *FastCGIServer) {
+	tripid := replaytestdata(t, sv)
+	_, err := sv.store.loadtripsummary(tripid)
+	if err != errNoTrip {
+		t.Fatalf("Trip summarized too soon, err %v", err)
+	}
+	agetodo(t, sv.store)
+	n, err := dosummarize(sv.store, "test", verbose)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := sv.store.loadtripsummary(tripid)
+	if err != nil || n != 1 {
+		t.Fatalf("Trip %s not summarized: %d trips, %v", tripid, n, err)
+	}
+	checktestsummary(t, r)
+	checktestsegments(t, sv.store, r)
+	checktestcrossings(t, sv.store, r)
+	agetodo(t, sv.store)
+	_, _, err = sv.store.pendingtrip()
+	if err != errNoPendingTrip {
+		t.Errorf("Trip still on to-do list after summarization, err %v", err)
+	}
+}
+
+func TestEventLogFromFile(t *testing.T) {
+	sv := newtestserver(t)
+	tripid := replaytestdata(t, sv)
+	events, err := sv.store.tripevents(tripid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 243 {
+		t.Errorf("Stored %d events, expected 243", len(events))
+	}
 }
 
 func TestSummarize(t *testing.T) {
-	err := dosummarize(testsv.db, false)
+	summarizetestdata(t, newtestserver(t))
+}
+
+func TestSummarizeSQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vehiclelogtest")
 	if err != nil {
-		t.Errorf(err.Error())
-		return
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := testcfg
+	config.Store = "sqlite"
+	config.Sqlite.Path = filepath.Join(dir, "vehicles.db")
+	sv := new(FastCGIServer)
+	err = initserver(config, sv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sv.store.close()
+	summarizetestdata(t, sv)
+}
+
+//
+//  brokenreader -- request body which fails partway through
+//
+type brokenreader struct{ sent bool }
+
+func (r *brokenreader) Read(p []byte) (int, error) {
+	if r.sent {
+		return 0, io.ErrUnexpectedEOF
+	}
+	r.sent = true
+	return copy(p, `{"tripid":`), nil
+}
+
+func TestRequestBody(t *testing.T) {
+	sv := newtestserver(t)
+	sv.config.Server.Maxbody = 1000
+	//  Valid event
+	testjson := []byte(strings.Replace(testjson1, "TRIPID", GenerateRandomTripid(), 1))
+	hdr := http.Header{}
+	for k, v := range testheader1 {
+		hdr[k] = v
+	}
+	SignLogMsg(testjson, hdr, testtokenname)
+	req := httptest.NewRequest("POST", "/", bytes.NewReader(testjson))
+	req.Header = hdr
+	w := httptest.NewRecorder()
+	sv.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Valid request: status %d, body %s", w.Code, w.Body.String())
+	}
+	//  Oversize body
+	req = httptest.NewRequest("POST", "/", bytes.NewReader(make([]byte, 1001)))
+	w = httptest.NewRecorder()
+	sv.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Oversize request: status %d, expected 413", w.Code)
+	}
+	//  Oversize body with no Content-Length
+	req = httptest.NewRequest("POST", "/", ioutil.NopCloser(bytes.NewReader(make([]byte, 5000))))
+	req.ContentLength = -1
+	w = httptest.NewRecorder()
+	sv.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Oversize chunked request: status %d, expected 413", w.Code)
+	}
+	//  Broken read
+	req = httptest.NewRequest("POST", "/", &brokenreader{})
+	req.Header = hdr
+	w = httptest.NewRecorder()
+	sv.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Broken read: status %d, expected 400", w.Code)
+	}
+	//  No body at all
+	req = httptest.NewRequest("POST", "/", nil)
+	req.Body = nil
+	w = httptest.NewRecorder()
+	sv.ServeHTTP(w, req)
+	var reply ingestresponse
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); w.Code != http.StatusBadRequest || err != nil || reply.Status != statusbadjson {
+		t.Errorf("No body: status %d, reply \"%s\", expected 400 %s", w.Code, w.Body.String(), statusbadjson)
+	}
+}
+
+//
+//  postevent -- send one event with the given header, return HTTP status and decoded reply
+//
+func postevent(t *testing.T, sv *FastCGIServer, body []byte, hdr http.Header) (int, ingestresponse) {
+	req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	req.Header = hdr
+	w := httptest.NewRecorder()
+	sv.ServeHTTP(w, req)
+	var reply ingestresponse
+	err := json.Unmarshal(w.Body.Bytes(), &reply)
+	if err != nil {
+		t.Fatalf("Response \"%s\" not valid JSON: %s", w.Body.String(), err)
+	}
+	return w.Code, reply
+}
+
+//
+//  signedheader -- copy of testheader1, signed for body
+//
+func signedheader(body []byte) http.Header {
+	hdr := http.Header{}
+	for k, v := range testheader1 {
+		hdr[k] = v
 	}
+	SignLogMsg(body, hdr, testtokenname)
+	return hdr
+}
 
+func TestResponseStatus(t *testing.T) {
+	sv := newtestserver(t)
+	tripid := GenerateRandomTripid()
+	testjson := []byte(strings.Replace(testjson1, "TRIPID", tripid, 1))
+	//  Good event, then the same one again
+	code, reply := postevent(t, sv, testjson, signedheader(testjson))
+	if code != http.StatusOK || reply.Status != statusok || reply.Tripid != tripid || reply.Received == 0 {
+		t.Errorf("Good event: got %d %+v", code, reply)
+	}
+	code, reply = postevent(t, sv, testjson, signedheader(testjson))
+	if code != http.StatusOK || reply.Status != statusduplicate {
+		t.Errorf("Resent event: got %d %s, expected 200 %s", code, reply.Status, statusduplicate)
+	}
+	//  Bad signature
+	hdr := signedheader(testjson)
+	hdr.Set("X-Authtoken-Hash", "0000000000000000000000000000000000000000")
+	code, reply = postevent(t, sv, testjson, hdr)
+	if code != http.StatusForbidden || reply.Status != statusbadauth {
+		t.Errorf("Bad signature: got %d %s, expected 403 %s", code, reply.Status, statusbadauth)
+	}
+	//  Unknown token name
+	hdr = signedheader(testjson)
+	hdr.Set("X-Authtoken-Name", "NOSUCHKEY")
+	code, reply = postevent(t, sv, testjson, hdr)
+	if code != http.StatusUnauthorized || reply.Status != statusbadauth {
+		t.Errorf("Unknown token: got %d %s, expected 401 %s", code, reply.Status, statusbadauth)
+	}
+	//  Missing region
+	hdr = signedheader(testjson)
+	hdr.Del("X-Secondlife-Region")
+	code, reply = postevent(t, sv, testjson, hdr)
+	if code != http.StatusBadRequest || reply.Status != statusbadheader {
+		t.Errorf("Missing region: got %d %s, expected 400 %s", code, reply.Status, statusbadheader)
+	}
+	//  Bad trip ID
+	badjson := []byte(strings.Replace(testjson1, "TRIPID", "TOOSHORT", 1))
+	code, reply = postevent(t, sv, badjson, signedheader(badjson))
+	if code != http.StatusBadRequest || reply.Status != statusbadjson || reply.Tripid != "TOOSHORT" {
+		t.Errorf("Bad trip ID: got %d %+v", code, reply)
+	}
+}
+
+func TestDuplicateConflict(t *testing.T) {
+	sv := newtestserver(t)
+	tripid := GenerateRandomTripid()
+	testjson := []byte(strings.Replace(testjson1, "TRIPID", tripid, 1))
+	code, _ := postevent(t, sv, testjson, signedheader(testjson))
+	if code != http.StatusOK {
+		t.Fatalf("Good event: got %d", code)
+	}
+	//  Same trip ID and serial, different message
+	otherjson := []byte(strings.Replace(string(testjson), "John Doe", "Jane Doe", 1))
+	code, reply := postevent(t, sv, otherjson, signedheader(otherjson))
+	if code != http.StatusConflict || reply.Status != statusconflict {
+		t.Errorf("Conflicting event: got %d %s, expected 409 %s", code, reply.Status, statusconflict)
+	}
+	events, _ := sv.store.tripevents(tripid)
+	if len(events) != 1 || events[0].ev.Msg != "John Doe" {
+		t.Errorf("Stored event changed by conflicting event: %v", events)
+	}
+	//  Same event from a different position is also a conflict
+	hdr := signedheader(testjson)
+	hdr.Set("X-Secondlife-Local-Position", "(1.0, 2.0, 3.0)")
+	code, _ = postevent(t, sv, testjson, hdr)
+	if code != http.StatusConflict {
+		t.Errorf("Moved event: got %d, expected 409", code)
+	}
+	errlog := sv.store.(*memstore).errlog
+	if len(errlog) != 2 || errlog[0].tripid != tripid || errlog[0].owner_name != "animats Resident" {
+		t.Errorf("Conflicts not in error log: %v", errlog)
+	}
+}
+
+//
+//  downstore -- a store whose database can't be reached
+//
+type downstore struct {
+	*memstore
+}
+
+func (s downstore) appendevent(hdr slheader, ev vehlogevent, n usednonce) error {
+	return dbfail(driver.ErrBadConn)
+}
+
+func TestDatabaseUnavailable(t *testing.T) {
+	sv := newtestserver(t)
+	sv.store = downstore{newmemstore()}
+	testjson := []byte(strings.Replace(testjson1, "TRIPID", GenerateRandomTripid(), 1))
+	code, reply := postevent(t, sv, testjson, signedheader(testjson))
+	if code != http.StatusServiceUnavailable || reply.Status != statusdberror {
+		t.Errorf("Database down: got %d %s, expected 503 %s", code, reply.Status, statusdberror)
+	}
 }
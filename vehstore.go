@@ -0,0 +1,86 @@
+//
+//  vehstore -- storage interface for events and trip summaries
+//
+//  The event logger and summarizer talk only to this interface, so
+//  the same pipeline runs against MySQL, SQLite, or memory.
+//
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+//
+//  Errors
+//
+var errNoPendingTrip = errors.New("no trip ready for summarization")
+var errNoTrip = errors.New("no such trip")
+var errNoEvent = errors.New("no such event")
+var errDuplicateEvent = errors.New("event with this trip ID and serial number already stored")
+var errConflictEvent = errors.New("different event with this trip ID and serial number already stored")
+var errReplayedNonce = errors.New("nonce already used; replayed message")
+var errLeaseLost = errors.New("lease on trip expired; another summarizer may have it")
+
+//
+//  tripevent -- one stored event, with the header data sent with it
+//
+type tripevent struct {
+	hdr slheader    // where and who
+	ev  vehlogevent // what
+}
+
+//
+//  errorlogentry -- a row of the errorlog table
+//
+type errorlogentry struct {
+	stamp      time.Time // when logged
+	owner_name string    // owner if relevant
+	tripid     string    // trip ID if relevant
+	category   string    // kind of error, such as bad_auth or summarize
+	msg        string    // error message
+}
+
+//
+//  vehstore -- what the logger and summarizer need from storage
+//
+type vehstore interface {
+	appendevent(hdr slheader, ev vehlogevent, n usednonce) error                       // add event and nonce and mark its trip pending, atomically; errReplayedNonce if nonce used
+	appendevents(events []tripevent, n usednonce) ([]error, error)                     // add events and nonce in one transaction; errDuplicateEvent per dup
+	prunenonces(before time.Time) error                                                // delete nonces signed before this
+	marktrippending(tripid string) error                                               // put trip on to-do list for summarization
+	pendingtrip() (string, time.Time, error)                                           // oldest unclaimed trip which is over, or errNoPendingTrip
+	claimtrip(worker string, leasesecs int) (string, time.Time, error)                 // pendingtrip, leased to worker so no other worker gets it
+	tripevents(tripid string) ([]tripevent, error)                                     // all events for trip, in serial order
+	loadevent(tripid string, serial int32) (tripevent, error)                          // one event, or errNoEvent
+	writetripsummary(worker string, r tripsummary) error                               // store summary, segments, crossings, and falls, and take trip off to-do list, if worker holds unexpired lease, else errLeaseLost
+	droptodo(worker string, tripid string, stamp time.Time) error                      // take trip with no events off to-do list, if worker holds lease
+	rebuildtripsummary(r tripsummary) error                                            // store recomputed summary, segments, crossings, and falls; to-do list untouched
+	loadtripsummary(tripid string) (tripsummary, error)                                // stored summary, or errNoTrip; no segments, crossings, or falls
+	tripsegments(tripid string) ([]tripsegment, error)                                 // stored segments of trip, in order visited
+	tripcrossings(tripid string) ([]crossing, error)                                   // stored crossings of trip, in order
+	tripfalls(tripid string) ([]fall, error)                                           // stored falls of trip, in order
+	findtrips(f tripfilter) ([]tripsummary, error)                                     // summaries selected by filter, newest first
+	regionstats(grid string) ([]regionstat, error)                                     // activity by grid and region; all grids if ""
+	boundarystats(grid string, mincrossings int, limit int) ([]boundarystat, error)    // crossings by boundary, worst first; all grids if ""
+	findfalls(grid string, region_name string, limit int) ([]fall, error)              // falls, newest first; all grids or regions if ""
+	logerror(e errorlogentry) error                                                    // add to error log
+	recenterrors(owner_name string, tripid string, limit int) ([]errorlogentry, error) // newest first
+	close() error
+}
+
+//
+//  openstore -- open the storage backend selected by the config file
+//
+func openstore(config vdbconfig) (vehstore, error) {
+	switch config.Store {
+	case "", "mysql":
+		return openmysqlstore(config)
+	case "sqlite":
+		return opensqlitestore(config.Sqlite.Path)
+	case "memory":
+		return newmemstore(), nil
+	}
+	return nil, fmt.Errorf("Unknown storage backend \"%s\" in config", config.Store)
+}